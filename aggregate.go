@@ -0,0 +1,256 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/*
+ * Jobs are summed up into series by a set of their attributes chosen as
+ * labels. The same aggregation backs the queue, accounts and users
+ * collectors as well as the aggregations defined in the configuration,
+ * so every site can pick the labels matching its cardinality budget.
+ */
+
+// Job attributes available as labels of aggregated job metrics
+var jobLabels = map[string]func(job *Job) string{
+	"account":   func(job *Job) string { return job.Account },
+	"array":     jobArrayID,
+	"gres":      func(job *Job) string { return GresTypes(job.Gres) },
+	"partition": func(job *Job) string { return job.Partition },
+	"qos":       func(job *Job) string { return job.QOS },
+	"reason":    func(job *Job) string { return job.Reason },
+	"state":     func(job *Job) string { return job.State },
+	"user":      func(job *Job) string { return job.User },
+}
+
+// ID of the job array of a task, e.g. 1234 of 1234_5, empty for other jobs
+func jobArrayID(job *Job) string {
+	if i := strings.Index(job.ID, "_"); i > 0 {
+		return job.ID[:i]
+	}
+	return ""
+}
+
+// GresTypes returns the names and types of generic resources without their
+// counts, e.g. gpu:a100 of gpu:a100:2
+func GresTypes(gres string) string {
+	var types []string
+	for _, entry := range strings.Split(stripParentheses(gres), ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+		if parts[0] == "" {
+			continue
+		}
+		if _, err := strconv.ParseFloat(parts[len(parts)-1], 64); err == nil && len(parts) > 1 {
+			parts = parts[:len(parts)-1]
+		}
+		types = append(types, strings.Join(parts, ":"))
+	}
+	return strings.Join(types, ",")
+}
+
+// Jobs and their requested resources of a single combination of label
+// values, memory in bytes
+type JobSeries struct {
+	labels []string
+	jobs   float64
+	cores  float64
+	nodes  float64
+	memory float64
+	gpus   float64
+}
+
+// AggregateJobs sums up the jobs and their requested resources by the
+// values of the given labels, the series are keyed by their joined label
+// values
+func AggregateJobs(jobs []Job, labels []string) map[string]*JobSeries {
+	series := make(map[string]*JobSeries)
+	for i := range jobs {
+		job := &jobs[i]
+		values := make([]string, len(labels))
+		for j, label := range labels {
+			values[j] = jobLabels[label](job)
+		}
+		key := strings.Join(values, "\xff")
+		if _, ok := series[key]; !ok {
+			series[key] = &JobSeries{labels: values}
+		}
+		series[key].jobs++
+		series[key].cores += job.CPUs
+		series[key].nodes += job.Nodes
+		series[key].memory += job.Memory
+		series[key].gpus += job.GPUs
+	}
+	return series
+}
+
+// Check that labels are known job attributes without duplicates
+func validateJobLabels(labels []string) error {
+	seen := make(map[string]bool)
+	for _, label := range labels {
+		if _, ok := jobLabels[label]; !ok || seen[label] {
+			return fmt.Errorf("invalid job label %q", label)
+		}
+		seen[label] = true
+	}
+	return nil
+}
+
+/*
+ * The AggregationsCollector exposes the jobs and requested resources of
+ * every aggregation in the configuration, as slurm_aggregate_<name>_jobs,
+ * slurm_aggregate_<name>_cores and so on, labeled with the chosen job
+ * attributes.
+ */
+
+type aggregation struct {
+	labels []string
+	jobs   *prometheus.Desc
+	cores  *prometheus.Desc
+	nodes  *prometheus.Desc
+	memory *prometheus.Desc
+	gpus   *prometheus.Desc
+}
+
+type AggregationsCollector struct {
+	slurm        *Slurm
+	aggregations map[string]*aggregation
+}
+
+func NewAggregationsCollector(slurm *Slurm) *AggregationsCollector {
+	return &AggregationsCollector{
+		slurm:        slurm,
+		aggregations: make(map[string]*aggregation),
+	}
+}
+
+// Add an aggregation of the jobs by the given labels
+func (ac *AggregationsCollector) Add(name string, labels []string) {
+	by := strings.Join(labels, ", ")
+	prefix := "slurm_aggregate_" + name
+	ac.aggregations[name] = &aggregation{
+		labels: labels,
+		jobs:   prometheus.NewDesc(prefix+"_jobs", "Jobs by "+by, labels, nil),
+		cores:  prometheus.NewDesc(prefix+"_cores", "Cores of the jobs by "+by, labels, nil),
+		nodes:  prometheus.NewDesc(prefix+"_nodes", "Nodes requested by the jobs by "+by, labels, nil),
+		memory: prometheus.NewDesc(prefix+"_memory_bytes", "Memory requested by the jobs by "+by, labels, nil),
+		gpus:   prometheus.NewDesc(prefix+"_gpus", "GPUs requested by the jobs by "+by, labels, nil),
+	}
+}
+
+func (ac *AggregationsCollector) configure(config *Config) {
+	for name, labels := range config.Aggregations {
+		ac.Add(name, labels)
+	}
+}
+
+func (ac *AggregationsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, a := range ac.aggregations {
+		ch <- a.jobs
+		ch <- a.cores
+		ch <- a.nodes
+		ch <- a.memory
+		ch <- a.gpus
+	}
+}
+
+func (ac *AggregationsCollector) Update(ch chan<- prometheus.Metric) error {
+	if len(ac.aggregations) == 0 {
+		return nil
+	}
+	jobs, err := ac.slurm.Jobs()
+	if err != nil {
+		return err
+	}
+	for _, a := range ac.aggregations {
+		for _, s := range AggregateJobs(jobs, a.labels) {
+			ch <- prometheus.MustNewConstMetric(a.jobs, prometheus.GaugeValue, s.jobs, s.labels...)
+			ch <- prometheus.MustNewConstMetric(a.cores, prometheus.GaugeValue, s.cores, s.labels...)
+			ch <- prometheus.MustNewConstMetric(a.nodes, prometheus.GaugeValue, s.nodes, s.labels...)
+			ch <- prometheus.MustNewConstMetric(a.memory, prometheus.GaugeValue, s.memory, s.labels...)
+			ch <- prometheus.MustNewConstMetric(a.gpus, prometheus.GaugeValue, s.gpus, s.labels...)
+		}
+	}
+	return nil
+}
+
+/*
+ * The accounts and users collectors expose the pending, running and
+ * suspended jobs and the running CPUs per account or user.
+ */
+
+type JobStatesCollector struct {
+	slurm        *Slurm
+	label        string
+	pending      *prometheus.Desc
+	running      *prometheus.Desc
+	running_cpus *prometheus.Desc
+	suspended    *prometheus.Desc
+}
+
+func newJobStatesCollector(slurm *Slurm, label string) *JobStatesCollector {
+	labels := []string{label}
+	return &JobStatesCollector{
+		slurm:        slurm,
+		label:        label,
+		pending:      prometheus.NewDesc("slurm_"+label+"_jobs_pending", "Pending jobs for "+label, labels, nil),
+		running:      prometheus.NewDesc("slurm_"+label+"_jobs_running", "Running jobs for "+label, labels, nil),
+		running_cpus: prometheus.NewDesc("slurm_"+label+"_cpus_running", "Running cpus for "+label, labels, nil),
+		suspended:    prometheus.NewDesc("slurm_"+label+"_jobs_suspended", "Suspended jobs for "+label, labels, nil),
+	}
+}
+
+func NewAccountsCollector(slurm *Slurm) *JobStatesCollector {
+	return newJobStatesCollector(slurm, "account")
+}
+
+func NewUsersCollector(slurm *Slurm) *JobStatesCollector {
+	return newJobStatesCollector(slurm, "user")
+}
+
+func (jc *JobStatesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- jc.pending
+	ch <- jc.running
+	ch <- jc.running_cpus
+	ch <- jc.suspended
+}
+
+func (jc *JobStatesCollector) Update(ch chan<- prometheus.Metric) error {
+	jobs, err := jc.slurm.Jobs()
+	if err != nil {
+		return err
+	}
+	for _, s := range AggregateJobs(jobs, []string{"state", jc.label}) {
+		state, value := s.labels[0], s.labels[1]
+		switch state {
+		case "PENDING":
+			ch <- prometheus.MustNewConstMetric(jc.pending, prometheus.GaugeValue, s.jobs, value)
+		case "RUNNING":
+			ch <- prometheus.MustNewConstMetric(jc.running, prometheus.GaugeValue, s.jobs, value)
+			if s.cores > 0 {
+				ch <- prometheus.MustNewConstMetric(jc.running_cpus, prometheus.GaugeValue, s.cores, value)
+			}
+		case "SUSPENDED":
+			ch <- prometheus.MustNewConstMetric(jc.suspended, prometheus.GaugeValue, s.jobs, value)
+		}
+	}
+	return nil
+}
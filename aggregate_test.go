@@ -0,0 +1,79 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGresTypes(t *testing.T) {
+	for gres, types := range map[string]string{
+		"":                        "",
+		"gpu:2":                   "gpu",
+		"gpu:a100:4(S:0-1)":       "gpu:a100",
+		"gpu:a100:2,gpu:v100:1":   "gpu:a100,gpu:v100",
+		"gpu:1g.5gb:7(IDX:0-6)":   "gpu:1g.5gb",
+		"gpu,mps:100":             "gpu,mps",
+		"gpu:tesla:1,shard:2(S:)": "gpu:tesla,shard",
+	} {
+		assert.Equal(t, types, GresTypes(gres), gres)
+	}
+}
+
+func TestAggregateJobs(t *testing.T) {
+	jobs := []Job{
+		{ID: "100_1", State: "RUNNING", CPUs: 4, Nodes: 1, Memory: 1 << 30, GPUs: 1, Gres: "gpu:a100:1"},
+		{ID: "100_2", State: "RUNNING", CPUs: 4, Nodes: 1, Memory: 1 << 30, GPUs: 1, Gres: "gpu:a100:1"},
+		{ID: "101", State: "PENDING", CPUs: 8, Nodes: 2, Memory: 4 << 30, GPUs: 4, Gres: "gpu:2"},
+	}
+	series := AggregateJobs(jobs, []string{"array", "gres"})
+	assert.Equal(t, 2, len(series))
+	assert.Equal(t, &JobSeries{[]string{"100", "gpu:a100"}, 2, 8, 2, 2 << 30, 2}, series["100\xffgpu:a100"])
+	assert.Equal(t, &JobSeries{[]string{"", "gpu"}, 1, 8, 2, 4 << 30, 4}, series["\xffgpu"])
+}
+
+func TestAggregationsCollector(t *testing.T) {
+	runner := NewFakeRunner().File(t, "squeue", "test_data/squeue.txt")
+	collector := NewAggregationsCollector(NewSlurm(NewCommandSource(runner)))
+	collector.Add("qos", []string{"qos"})
+	collector.Add("gpu_jobs", []string{"gres", "state"})
+	expected := `
+# HELP slurm_aggregate_gpu_jobs_cores Cores of the jobs by gres, state
+# TYPE slurm_aggregate_gpu_jobs_cores gauge
+slurm_aggregate_gpu_jobs_cores{gres="gpu",state="RUNNING"} 12
+slurm_aggregate_gpu_jobs_cores{gres="gpu:a100",state="PENDING"} 12
+# HELP slurm_aggregate_qos_jobs Jobs by qos
+# TYPE slurm_aggregate_qos_jobs gauge
+slurm_aggregate_qos_jobs{qos="high"} 11
+slurm_aggregate_qos_jobs{qos="low"} 11
+slurm_aggregate_qos_jobs{qos="normal"} 20
+`
+	// Only the jobs requesting GPUs
+	filter := &LabelFilter{Label: "gres", Keep: ".+"}
+	if err := filter.compile(); err != nil {
+		t.Fatal(err)
+	}
+	exporter := NewSlurmExporter(map[string]Collector{"aggregations": collector})
+	filtered := filterCollector(exporter, []*LabelFilter{filter})
+	if err := testutil.CollectAndCompare(filtered, strings.NewReader(expected),
+		"slurm_aggregate_gpu_jobs_cores", "slurm_aggregate_qos_jobs"); err != nil {
+		t.Error(err)
+	}
+}
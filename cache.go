@@ -0,0 +1,181 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+var errNotRefreshed = errors.New("waiting for the first refresh")
+
+/*
+ * CachedCollector queries Slurm in the background on its own interval and
+ * serves the metrics of the last refresh on every scrape, so the load on
+ * slurmctld does not depend on how many servers scrape the exporter.
+ * When the last refresh failed, Update still sends the metrics of the last
+ * successful refresh and returns the error, reported as a failure of the
+ * collector while the last success timestamp tells how old the metrics are.
+ */
+
+type CachedCollector struct {
+	name      string
+	collector Collector
+	interval  time.Duration
+	stop      chan struct{}
+
+	mu          sync.RWMutex
+	metrics     []prometheus.Metric
+	err         error
+	lastSuccess time.Time
+	duration    time.Duration
+}
+
+func NewCachedCollector(name string, collector Collector, interval time.Duration) *CachedCollector {
+	return &CachedCollector{
+		name:      name,
+		collector: collector,
+		interval:  interval,
+		stop:      make(chan struct{}),
+		err:       errNotRefreshed,
+	}
+}
+
+// Start refreshing the metrics in the background until Stop is called
+func (c *CachedCollector) Start() {
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		c.refresh()
+		for {
+			select {
+			case <-ticker.C:
+				c.refresh()
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Seed the metrics with the last refresh of another collector, e.g. the
+// one replaced on a reload, until the first refresh
+func (c *CachedCollector) Seed(other *CachedCollector) {
+	other.mu.RLock()
+	defer other.mu.RUnlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metrics = other.metrics
+	c.err = other.err
+	c.lastSuccess = other.lastSuccess
+	c.duration = other.duration
+}
+
+func (c *CachedCollector) Stop() {
+	close(c.stop)
+}
+
+func (c *CachedCollector) refresh() {
+	var metrics []prometheus.Metric
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		for m := range ch {
+			metrics = append(metrics, m)
+		}
+		close(done)
+	}()
+	start := time.Now()
+	err := c.collector.Update(ch)
+	close(ch)
+	<-done
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.duration = time.Since(start)
+	c.err = err
+	if err != nil {
+		log.Errorf("refresh of collector %s failed: %v", c.name, err)
+		return
+	}
+	c.metrics = metrics
+	c.lastSuccess = start
+}
+
+// Send all metric descriptions
+func (c *CachedCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.collector.Describe(ch)
+}
+
+// Send the metrics of the last successful refresh and the error of the last
+// refresh
+func (c *CachedCollector) Update(ch chan<- prometheus.Metric) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, m := range c.metrics {
+		ch <- m
+	}
+	return c.err
+}
+
+// LastRefresh returns the start of the last successful refresh and the
+// time spent by the last refresh.
+func (c *CachedCollector) LastRefresh() (time.Time, time.Duration) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lastSuccess, c.duration
+}
+
+/*
+ * A snapshot shares the result of an expensive Slurm query between the
+ * collectors running during the same scrape (or background refresh).
+ * Concurrent callers wait for the query in flight and results younger
+ * than maxAge are reused instead of querying Slurm again.
+ */
+
+type snapshot struct {
+	fetch  func() (interface{}, error)
+	maxAge time.Duration
+
+	mu    sync.Mutex
+	value interface{}
+	err   error
+	time  time.Time
+}
+
+// Results younger than this are shared between collectors
+const snapshotMaxAge = 5 * time.Second
+
+func newSnapshot(fetch func() (interface{}, error)) *snapshot {
+	return &snapshot{
+		fetch:  fetch,
+		maxAge: snapshotMaxAge,
+	}
+}
+
+func (s *snapshot) get() (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.time.IsZero() || time.Since(s.time) >= s.maxAge {
+		s.value, s.err = s.fetch()
+		s.time = time.Now()
+	}
+	return s.value, s.err
+}
@@ -0,0 +1,53 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCachedCollector(t *testing.T) {
+	runner := NewFakeRunner().File(t, "sinfo", "test_data/sinfo_nodes.txt")
+	slurm := NewSlurm(NewCommandSource(runner))
+	// Query Slurm on every refresh instead of sharing recent results
+	slurm.nodes.maxAge = 0
+	cached := NewCachedCollector("cpus", NewCPUsCollector(slurm), time.Minute)
+	exporter := NewSlurmExporter(map[string]Collector{"cpus": cached})
+
+	// Nothing is served before the first refresh
+	assert.Equal(t, 0.0, testutil.ToFloat64(metricsNamed(exporter, "slurm_exporter_collector_success")))
+
+	cached.refresh()
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, 288.0, testutil.ToFloat64(metricsNamed(exporter, "slurm_cpus_total")))
+	}
+	assert.Equal(t, 1, len(runner.Calls))
+	lastSuccess, _ := cached.LastRefresh()
+	assert.False(t, lastSuccess.IsZero())
+
+	runner.Errors["sinfo"] = errors.New("slurm_load_partitions: Unable to contact slurm controller")
+	cached.refresh()
+	assert.Equal(t, 0.0, testutil.ToFloat64(metricsNamed(exporter, "slurm_exporter_collector_success")))
+	// The metrics of the last successful refresh are kept
+	assert.Equal(t, 288.0, testutil.ToFloat64(metricsNamed(exporter, "slurm_cpus_total")))
+	failed, _ := cached.LastRefresh()
+	assert.Equal(t, lastSuccess, failed)
+}
@@ -0,0 +1,100 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/*
+ * A Cluster holds the collectors of a single Slurm cluster. When several
+ * clusters are scraped by the same exporter, every metric of a cluster
+ * carries its name in the cluster label.
+ */
+
+type Cluster struct {
+	// Name of the cluster, empty if only the local cluster is scraped
+	Name       string
+	Collectors map[string]Collector
+	// Exposes the counters of the Slurm commands, optional
+	Commands prometheus.Collector
+	// Drop series by label value
+	Filters []*LabelFilter
+}
+
+func NewCluster(name string, source Source, names []string) (*Cluster, error) {
+	collectors, err := NewCollectors(source, names)
+	if err != nil {
+		return nil, err
+	}
+	return &Cluster{
+		Name:       name,
+		Collectors: collectors,
+	}, nil
+}
+
+// Apply the configuration to the cluster and its collectors
+func (c *Cluster) Configure(config *Config) {
+	c.Filters = config.Filters
+	for _, collector := range c.Collectors {
+		if cc, ok := collector.(configurable); ok {
+			cc.configure(config)
+		}
+	}
+}
+
+// Seed the collectors with the state of the same collectors of another
+// cluster, e.g. the one replaced on a reload
+func (c *Cluster) Seed(other *Cluster) {
+	for name, collector := range c.Collectors {
+		sc, ok := collector.(seedable)
+		if !ok {
+			continue
+		}
+		previous := other.Collectors[name]
+		if cached, ok := previous.(*CachedCollector); ok {
+			previous = cached.collector
+		}
+		if previous != nil {
+			sc.seed(previous)
+		}
+	}
+}
+
+// Wrap the registerer to add the cluster label to all metrics
+func (c *Cluster) registerer(registerer prometheus.Registerer) prometheus.Registerer {
+	if c.Name == "" {
+		return registerer
+	}
+	return prometheus.WrapRegistererWith(prometheus.Labels{"cluster": c.Name}, registerer)
+}
+
+// Exporter running the given collectors of the cluster
+func (c *Cluster) exporter(collectors map[string]Collector) prometheus.Collector {
+	return filterCollector(NewSlurmExporter(collectors), c.Filters)
+}
+
+// Register the metrics of all collectors and commands of the cluster
+func (c *Cluster) Register(registerer prometheus.Registerer) error {
+	registerer = c.registerer(registerer)
+	if err := registerer.Register(c.exporter(c.Collectors)); err != nil {
+		return err
+	}
+	if c.Commands != nil {
+		return registerer.Register(c.Commands)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClusters(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	var clusters []*Cluster
+	runners := make(map[string]*FakeRunner)
+	for _, name := range []string{"alpha", "beta"} {
+		runners[name] = NewFakeRunner().File(t, "sinfo", "test_data/sinfo_nodes.txt")
+		commands := NewInstrumentedRunner(&ClusterRunner{Runner: runners[name], Cluster: name})
+		cluster, err := NewCluster(name, NewCommandSource(commands), []string{"cpus"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cluster.Commands = commands
+		assert.Nil(t, cluster.Register(registry))
+		clusters = append(clusters, cluster)
+	}
+	expected := `
+# HELP slurm_cpus_total Total CPUs
+# TYPE slurm_cpus_total gauge
+slurm_cpus_total{cluster="alpha"} 288
+slurm_cpus_total{cluster="beta"} 288
+# HELP slurm_exporter_collector_success Whether the collector succeeded to query Slurm during the last scrape
+# TYPE slurm_exporter_collector_success gauge
+slurm_exporter_collector_success{cluster="alpha",collector="cpus"} 1
+slurm_exporter_collector_success{cluster="beta",collector="cpus"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"slurm_cpus_total", "slurm_exporter_collector_success"); err != nil {
+		t.Error(err)
+	}
+	assert.True(t, strings.HasPrefix(runners["alpha"].Calls[0], "sinfo -M alpha "))
+	assert.True(t, strings.HasPrefix(runners["beta"].Calls[0], "sinfo -M beta "))
+
+	// Filtered scrapes cover all clusters as well
+	rec := httptest.NewRecorder()
+	NewMetricsHandler(clusters, http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics?collect[]=cpus", nil))
+	body, _ := ioutil.ReadAll(rec.Body)
+	assert.Contains(t, string(body), `slurm_cpus_total{cluster="alpha"} 288`)
+	assert.Contains(t, string(body), `slurm_cpus_total{cluster="beta"} 288`)
+}
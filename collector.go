@@ -0,0 +1,171 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// Collector is implemented by every Slurm collector. Update queries Slurm
+// and sends the resulting metrics on ch. When Slurm can not be queried
+// Update returns an error without sending any metric.
+type Collector interface {
+	Describe(ch chan<- *prometheus.Desc)
+	Update(ch chan<- prometheus.Metric) error
+}
+
+// Implemented by collectors serving metrics gathered before the scrape
+type refresher interface {
+	LastRefresh() (lastSuccess time.Time, duration time.Duration)
+}
+
+// Implemented by collectors with options in the configuration
+type configurable interface {
+	configure(config *Config)
+}
+
+// Implemented by collectors keeping state between updates, taken over from
+// the collector they replace on a reload
+type seedable interface {
+	seed(other Collector)
+}
+
+// Factory and default state of every collector known to the exporter
+type collectorEntry struct {
+	enabled bool
+	factory func(slurm *Slurm) Collector
+}
+
+var collectorEntries = map[string]collectorEntry{
+	"accounts":     {true, func(s *Slurm) Collector { return NewAccountsCollector(s) }},     // from aggregate.go
+	"aggregations": {true, func(s *Slurm) Collector { return NewAggregationsCollector(s) }}, // from aggregate.go
+	"controllers":  {true, func(s *Slurm) Collector { return NewControllersCollector(s) }},  // from controllers.go
+	"cpus":         {true, func(s *Slurm) Collector { return NewCPUsCollector(s) }},         // from cpus.go
+	"fairshare":    {true, func(s *Slurm) Collector { return NewFairShareCollector(s) }},    // from sshare.go
+	"gpus":         {false, func(s *Slurm) Collector { return NewGPUsCollector(s) }},        // from gpus.go
+	"jobs":         {false, func(s *Slurm) Collector { return NewJobCollector(s) }},         // from job.go
+	"node":         {true, func(s *Slurm) Collector { return NewNodeCollector(s) }},         // from node.go
+	"nodes":        {true, func(s *Slurm) Collector { return NewNodesCollector(s) }},        // from nodes.go
+	"partitions":   {true, func(s *Slurm) Collector { return NewPartitionsCollector(s) }},   // from partitions.go
+	"queue":        {true, func(s *Slurm) Collector { return NewQueueCollector(s) }},        // from queue.go
+	"scheduler":    {true, func(s *Slurm) Collector { return NewSchedulerCollector(s) }},    // from scheduler.go
+	"tres":         {false, func(s *Slurm) Collector { return NewTRESCollector(s) }},        // from tres.go
+	"users":        {true, func(s *Slurm) Collector { return NewUsersCollector(s) }},        // from aggregate.go
+}
+
+// NewCollectors creates the named collectors, all sharing the same
+// source of Slurm data and snapshots.
+func NewCollectors(source Source, names []string) (map[string]Collector, error) {
+	slurm := NewSlurm(source)
+	collectors := make(map[string]Collector)
+	for _, name := range names {
+		entry, ok := collectorEntries[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown collector %q", name)
+		}
+		collectors[name] = entry.factory(slurm)
+	}
+	return collectors, nil
+}
+
+/*
+ * The SlurmExporter implements the Prometheus Collector interface on top
+ * of the individual Slurm collectors. A failing collector is logged and
+ * reported with slurm_exporter_collector_success, the metrics of all the
+ * other collectors are still exposed. The time spent by every collector
+ * is exposed with slurm_exporter_collector_duration_seconds and the time
+ * of its last success with slurm_exporter_collector_last_success_timestamp_seconds.
+ */
+
+type SlurmExporter struct {
+	collectors  map[string]Collector
+	success     *prometheus.Desc
+	duration    *prometheus.Desc
+	lastSuccess *prometheus.Desc
+}
+
+func NewSlurmExporter(collectors map[string]Collector) *SlurmExporter {
+	return &SlurmExporter{
+		collectors: collectors,
+		success: prometheus.NewDesc(
+			"slurm_exporter_collector_success",
+			"Whether the collector succeeded to query Slurm during the last scrape",
+			[]string{"collector"},
+			nil),
+		duration: prometheus.NewDesc(
+			"slurm_exporter_collector_duration_seconds",
+			"Time spent by the collector to query Slurm during the last scrape or background refresh",
+			[]string{"collector"},
+			nil),
+		lastSuccess: prometheus.NewDesc(
+			"slurm_exporter_collector_last_success_timestamp_seconds",
+			"Time when the collector last succeeded to query Slurm",
+			[]string{"collector"},
+			nil),
+	}
+}
+
+// Send all metric descriptions
+func (e *SlurmExporter) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range e.collectors {
+		c.Describe(ch)
+	}
+	ch <- e.success
+	ch <- e.duration
+	ch <- e.lastSuccess
+}
+
+// Run all collectors concurrently and send their metrics
+func (e *SlurmExporter) Collect(ch chan<- prometheus.Metric) {
+	var wg sync.WaitGroup
+	wg.Add(len(e.collectors))
+	for name, c := range e.collectors {
+		go func(name string, c Collector) {
+			defer wg.Done()
+			e.update(name, c, ch)
+		}(name, c)
+	}
+	wg.Wait()
+}
+
+func (e *SlurmExporter) update(name string, c Collector, ch chan<- prometheus.Metric) {
+	start := time.Now()
+	err := c.Update(ch)
+	duration := time.Since(start)
+	var lastSuccess time.Time
+	if err == nil {
+		lastSuccess = start
+	}
+	// Cached collectors report on their last background refresh instead
+	if r, ok := c.(refresher); ok {
+		lastSuccess, duration = r.LastRefresh()
+	}
+	success := 1.0
+	if err != nil {
+		log.Errorf("collector %s failed after %.3fs: %v", name, duration.Seconds(), err)
+		success = 0
+	}
+	ch <- prometheus.MustNewConstMetric(e.success, prometheus.GaugeValue, success, name)
+	ch <- prometheus.MustNewConstMetric(e.duration, prometheus.GaugeValue, duration.Seconds(), name)
+	if !lastSuccess.IsZero() {
+		ch <- prometheus.MustNewConstMetric(e.lastSuccess, prometheus.GaugeValue, float64(lastSuccess.UnixNano())/1e9, name)
+	}
+}
@@ -0,0 +1,75 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSlurmExporterCollectorFailure(t *testing.T) {
+	runner := NewFakeRunner().File(t, "sinfo", "test_data/sinfo_nodes.txt")
+	runner.Errors["sshare"] = errors.New("sshare: error: Problem talking to the database")
+	slurm := NewSlurm(NewCommandSource(runner))
+	exporter := NewSlurmExporter(map[string]Collector{
+		"cpus":      NewCPUsCollector(slurm),
+		"fairshare": NewFairShareCollector(slurm),
+	})
+	expected := `
+# HELP slurm_cpus_total Total CPUs
+# TYPE slurm_cpus_total gauge
+slurm_cpus_total 288
+# HELP slurm_exporter_collector_success Whether the collector succeeded to query Slurm during the last scrape
+# TYPE slurm_exporter_collector_success gauge
+slurm_exporter_collector_success{collector="cpus"} 1
+slurm_exporter_collector_success{collector="fairshare"} 0
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected),
+		"slurm_cpus_total", "slurm_account_fairshare", "slurm_exporter_collector_success"); err != nil {
+		t.Error(err)
+	}
+}
+
+// Collector passing on only the metrics with the given name
+type namedCollector struct {
+	collector prometheus.Collector
+	name      string
+}
+
+func metricsNamed(c prometheus.Collector, name string) prometheus.Collector {
+	return namedCollector{c, name}
+}
+
+func (n namedCollector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(n, ch)
+}
+
+func (n namedCollector) Collect(ch chan<- prometheus.Metric) {
+	all := make(chan prometheus.Metric)
+	go func() {
+		n.collector.Collect(all)
+		close(all)
+	}()
+	for m := range all {
+		if strings.Contains(m.Desc().String(), `fqName: "`+n.name+`"`) {
+			ch <- m
+		}
+	}
+}
@@ -0,0 +1,244 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+ * The configuration of the exporter is built from the command line options
+ * and optionally overridden by a YAML file, which can be reloaded at
+ * runtime. Options missing in the file keep the value from the command
+ * line, e.g.
+ *
+ *   collectors:
+ *     gpus: true
+ *     fairshare: false
+ *   slurm:
+ *     bin_dir: /opt/slurm/bin
+ *     timeout: 1m
+ *     command_timeouts:
+ *       sacct: 2m
+ *     clusters: [alpha, beta]
+ *   poll:
+ *     interval: 30s
+ *   queue:
+ *     labels: [partition, qos]
+ *   aggregations:
+ *     gpu_jobs: [qos, gres, state]
+ *   jobs:
+ *     limit: 100
+ *   gpus:
+ *     allocation: sacct
+ *   scheduler:
+ *     rpc_user_limit: 20
+ *   filters:
+ *     - label: partition
+ *       drop: debug|test
+ */
+
+type Config struct {
+	// Enabled state of the collectors by name
+	Collectors map[string]bool `yaml:"collectors"`
+	Slurm      SlurmConfig     `yaml:"slurm"`
+	Poll       PollConfig      `yaml:"poll"`
+	Queue      QueueConfig     `yaml:"queue"`
+	// Labels of the job aggregations by name
+	Aggregations map[string][]string `yaml:"aggregations"`
+	Jobs         JobsConfig          `yaml:"jobs"`
+	GPUs         GPUsConfig          `yaml:"gpus"`
+	Scheduler    SchedulerConfig     `yaml:"scheduler"`
+	Filters      []*LabelFilter      `yaml:"filters"`
+}
+
+type SlurmConfig struct {
+	BinDir          string                   `yaml:"bin_dir"`
+	Paths           map[string]string        `yaml:"paths"`
+	Timeout         time.Duration            `yaml:"timeout"`
+	CommandTimeouts map[string]time.Duration `yaml:"command_timeouts"`
+	OutputFormat    string                   `yaml:"output_format"`
+	Clusters        []string                 `yaml:"clusters"`
+	Rest            RestConfig               `yaml:"rest"`
+}
+
+type RestConfig struct {
+	URL        string `yaml:"url"`
+	APIVersion string `yaml:"api_version"`
+	User       string `yaml:"user"`
+	TokenFile  string `yaml:"token_file"`
+}
+
+type PollConfig struct {
+	Interval           time.Duration            `yaml:"interval"`
+	CollectorIntervals map[string]time.Duration `yaml:"collector_intervals"`
+}
+
+// Options of the queue collector
+type QueueConfig struct {
+	// Job attributes exposed as labels, e.g. user, partition, account, qos
+	Labels []string `yaml:"labels"`
+}
+
+// Options of the jobs collector
+type JobsConfig struct {
+	// Number of jobs exposed, those requesting the most resources
+	Limit int `yaml:"limit"`
+}
+
+// Options of the gpus collector
+type GPUsConfig struct {
+	// Source of the allocated GPUs: gres (default if empty) or sacct
+	Allocation string `yaml:"allocation"`
+}
+
+// Options of the scheduler collector
+type SchedulerConfig struct {
+	// Number of users exposed with their RPC stats, 0 exposes all users
+	RPCUserLimit int `yaml:"rpc_user_limit"`
+}
+
+// Copy the configuration, so a file loaded on top does not change it
+func (c *Config) clone() *Config {
+	clone := *c
+	clone.Collectors = make(map[string]bool)
+	for name, enabled := range c.Collectors {
+		clone.Collectors[name] = enabled
+	}
+	clone.Slurm.Paths = make(map[string]string)
+	for command, path := range c.Slurm.Paths {
+		clone.Slurm.Paths[command] = path
+	}
+	clone.Slurm.CommandTimeouts = make(map[string]time.Duration)
+	for command, timeout := range c.Slurm.CommandTimeouts {
+		clone.Slurm.CommandTimeouts[command] = timeout
+	}
+	clone.Slurm.Clusters = append([]string(nil), c.Slurm.Clusters...)
+	clone.Poll.CollectorIntervals = make(map[string]time.Duration)
+	for name, interval := range c.Poll.CollectorIntervals {
+		clone.Poll.CollectorIntervals[name] = interval
+	}
+	clone.Queue.Labels = append([]string(nil), c.Queue.Labels...)
+	clone.Aggregations = make(map[string][]string)
+	for name, labels := range c.Aggregations {
+		clone.Aggregations[name] = append([]string(nil), labels...)
+	}
+	clone.Filters = append([]*LabelFilter(nil), c.Filters...)
+	return &clone
+}
+
+// LoadConfig reads the YAML file on top of the given configuration, an
+// empty path returns the given configuration
+func LoadConfig(path string, defaults *Config) (*Config, error) {
+	config := defaults.clone()
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		// Options set in the file replace those from the command line, a
+		// strict parse on its own catches unknown options
+		if err := yaml.UnmarshalStrict(data, &Config{}); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if err := yaml.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if err := config.validate(); err != nil {
+		if path != "" {
+			err = fmt.Errorf("%s: %v", path, err)
+		}
+		return nil, err
+	}
+	return config, nil
+}
+
+// Aggregation names are part of the metric names
+var aggregationName = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+func (c *Config) validate() error {
+	for name := range c.Collectors {
+		if _, ok := collectorEntries[name]; !ok {
+			return fmt.Errorf("unknown collector %q", name)
+		}
+	}
+	for name := range c.Poll.CollectorIntervals {
+		if _, ok := collectorEntries[name]; !ok {
+			return fmt.Errorf("unknown collector %q", name)
+		}
+	}
+	switch c.Slurm.OutputFormat {
+	case FormatAuto, FormatJSON, FormatText:
+	default:
+		return fmt.Errorf("unknown output format %q", c.Slurm.OutputFormat)
+	}
+	// The queue metrics are per state and pending jobs per reason already
+	for _, label := range c.Queue.Labels {
+		if label == "state" || label == "reason" {
+			return fmt.Errorf("invalid queue label %q", label)
+		}
+	}
+	if err := validateJobLabels(c.Queue.Labels); err != nil {
+		return fmt.Errorf("queue: %v", err)
+	}
+	for name, labels := range c.Aggregations {
+		if !aggregationName.MatchString(name) {
+			return fmt.Errorf("invalid aggregation name %q", name)
+		}
+		if err := validateJobLabels(labels); err != nil {
+			return fmt.Errorf("aggregation %s: %v", name, err)
+		}
+	}
+	switch c.GPUs.Allocation {
+	case "", GPUsAllocGres, GPUsAllocSacct:
+	default:
+		return fmt.Errorf("unknown GPUs allocation source %q", c.GPUs.Allocation)
+	}
+	if c.Jobs.Limit < 0 {
+		return fmt.Errorf("invalid jobs limit %d", c.Jobs.Limit)
+	}
+	if c.Scheduler.RPCUserLimit < 0 {
+		return fmt.Errorf("invalid RPC user limit %d", c.Scheduler.RPCUserLimit)
+	}
+	if c.Slurm.Rest.URL != "" && len(c.Slurm.Clusters) > 0 {
+		return fmt.Errorf("clusters are not supported with the REST API")
+	}
+	for _, filter := range c.Filters {
+		if err := filter.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EnabledCollectors returns the sorted names of the enabled collectors
+func (c *Config) EnabledCollectors() []string {
+	names := make([]string, 0, len(c.Collectors))
+	for name, enabled := range c.Collectors {
+		if enabled {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
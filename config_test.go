@@ -0,0 +1,103 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testDefaults() *Config {
+	return &Config{
+		Collectors: map[string]bool{"cpus": true, "fairshare": true, "gpus": false},
+		Slurm: SlurmConfig{
+			BinDir:          "/usr/bin",
+			Paths:           map[string]string{"sdiag": "/opt/slurm/bin/sdiag"},
+			Timeout:         30 * time.Second,
+			CommandTimeouts: map[string]time.Duration{},
+			OutputFormat:    FormatText,
+		},
+	}
+}
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	defaults := testDefaults()
+	config, err := LoadConfig(writeConfig(t, `
+collectors:
+  gpus: true
+  fairshare: false
+slurm:
+  timeout: 1m
+  paths:
+    sacct: /opt/slurm/bin/sacct
+  command_timeouts:
+    sacct: 2m
+  clusters: [alpha, beta]
+poll:
+  interval: 30s
+filters:
+  - label: partition
+    drop: debug|test
+`), defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"cpus", "gpus"}, config.EnabledCollectors())
+	assert.Equal(t, "/usr/bin", config.Slurm.BinDir)
+	assert.Equal(t, time.Minute, config.Slurm.Timeout)
+	assert.Equal(t, map[string]string{"sdiag": "/opt/slurm/bin/sdiag", "sacct": "/opt/slurm/bin/sacct"}, config.Slurm.Paths)
+	assert.Equal(t, 2*time.Minute, config.Slurm.CommandTimeouts["sacct"])
+	assert.Equal(t, []string{"alpha", "beta"}, config.Slurm.Clusters)
+	assert.Equal(t, 30*time.Second, config.Poll.Interval)
+	assert.Equal(t, "partition", config.Filters[0].Label)
+
+	// The command line options are left untouched
+	assert.Equal(t, []string{"cpus", "fairshare"}, defaults.EnabledCollectors())
+	assert.Equal(t, 1, len(defaults.Slurm.Paths))
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, content := range []string{
+		"collectors:\n  foo: true\n",
+		"slurm:\n  bin-dir: /opt/slurm/bin\n",
+		"slurm:\n  output_format: xml\n",
+		"filters:\n  - label: user\n    keep: '('\n",
+		"jobs:\n  limit: -1\n",
+		"gpus:\n  allocation: squeue\n",
+		"scheduler:\n  rpc_user_limit: -1\n",
+		"queue:\n  labels: [user, node]\n",
+		"queue:\n  labels: [state]\n",
+		"aggregations:\n  gpu-jobs: [gres]\n",
+		"aggregations:\n  gpu_jobs: [gres, gres]\n",
+	} {
+		_, err := LoadConfig(writeConfig(t, content), testDefaults())
+		assert.Error(t, err, content)
+	}
+	_, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yml"), testDefaults())
+	assert.Error(t, err)
+}
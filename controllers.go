@@ -0,0 +1,159 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/*
+ * Execute scontrol ping to check which of the primary and backup slurmctld
+ * are responding, e.g.
+ *
+ *   Slurmctld(primary) at ctl1 is DOWN
+ *   Slurmctld(backup) at ctl2 is UP
+ *
+ * Slurm before 18.08 prints a single line for both controllers like
+ * "Slurmctld(primary/backup) at ctl1/ctl2 are UP/DOWN".
+ */
+
+// Controller is a slurmctld in the order of SlurmctldHost
+type Controller struct {
+	Host string
+	// primary, backup or backup<n>
+	Mode string
+	Up   bool
+	// Round-trip time of the ping in seconds, zero if not reported
+	Latency float64
+}
+
+// scontrol ping exits with an error if a controller is down, the output
+// lists all controllers nevertheless
+func pingOutput(out []byte, err error) ([]byte, error) {
+	if cerr, ok := err.(*CommandError); ok && len(cerr.Stdout) > 0 {
+		return cerr.Stdout, nil
+	}
+	return out, err
+}
+
+// Execute the scontrol ping command and return its output
+func ControllersData(runner Runner) ([]byte, error) {
+	return pingOutput(runner.Run("scontrol", "ping"))
+}
+
+var pingLine = regexp.MustCompile(`^Slurmctld\((\S+)\) at (\S+) (?:is|are) (\S+)`)
+
+// ParseControllers extracts the controllers from the scontrol ping output
+func ParseControllers(input []byte) []Controller {
+	var controllers []Controller
+	for _, line := range strings.Split(string(input), "\n") {
+		match := pingLine.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
+		}
+		modes := strings.Split(match[1], "/")
+		hosts := strings.Split(match[2], "/")
+		states := strings.Split(match[3], "/")
+		for i, mode := range modes {
+			if i >= len(hosts) || i >= len(states) {
+				break
+			}
+			controllers = append(controllers, Controller{
+				Host: hosts[i],
+				Mode: mode,
+				Up:   strings.TrimRight(states[i], ".") == "UP",
+			})
+		}
+	}
+	return controllers
+}
+
+// Returns the controllers of the cluster
+func ControllersGetMetrics(runner Runner) ([]Controller, error) {
+	data, err := ControllersData(runner)
+	if err != nil {
+		return nil, err
+	}
+	return ParseControllers(data), nil
+}
+
+// ActiveController returns the index of the controller serving the cluster,
+// the first one responding like the Slurm clients choose it, -1 if all are
+// down
+func ActiveController(controllers []Controller) int {
+	for i, controller := range controllers {
+		if controller.Up {
+			return i
+		}
+	}
+	return -1
+}
+
+/*
+ * The ControllersCollector exposes whether every slurmctld responds and
+ * which one currently acts as primary, e.g. to alert on a failover to the
+ * backup controller. The latency is only reported by the JSON output of
+ * scontrol ping and the REST API.
+ */
+
+type ControllersCollector struct {
+	slurm   *Slurm
+	up      *prometheus.Desc
+	primary *prometheus.Desc
+	latency *prometheus.Desc
+}
+
+func NewControllersCollector(slurm *Slurm) *ControllersCollector {
+	labels := []string{"host", "mode"}
+	return &ControllersCollector{
+		slurm:   slurm,
+		up:      prometheus.NewDesc("slurm_controller_up", "Whether the slurmctld responds to scontrol ping", labels, nil),
+		primary: prometheus.NewDesc("slurm_controller_primary", "Whether the slurmctld currently serves the cluster, the first one responding", labels, nil),
+		latency: prometheus.NewDesc("slurm_controller_latency_seconds", "Round-trip time of the ping of the slurmctld", labels, nil),
+	}
+}
+
+func (cc *ControllersCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cc.up
+	ch <- cc.primary
+	ch <- cc.latency
+}
+
+func (cc *ControllersCollector) Update(ch chan<- prometheus.Metric) error {
+	controllers, err := cc.slurm.Controllers()
+	if err != nil {
+		return err
+	}
+	active := ActiveController(controllers)
+	for i, controller := range controllers {
+		up, primary := 0.0, 0.0
+		if controller.Up {
+			up = 1
+		}
+		if i == active {
+			primary = 1
+		}
+		ch <- prometheus.MustNewConstMetric(cc.up, prometheus.GaugeValue, up, controller.Host, controller.Mode)
+		ch <- prometheus.MustNewConstMetric(cc.primary, prometheus.GaugeValue, primary, controller.Host, controller.Mode)
+		if controller.Up && controller.Latency > 0 {
+			ch <- prometheus.MustNewConstMetric(cc.latency, prometheus.GaugeValue, controller.Latency, controller.Host, controller.Mode)
+		}
+	}
+	return nil
+}
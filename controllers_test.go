@@ -0,0 +1,56 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseControllers(t *testing.T) {
+	assert.Equal(t, []Controller{
+		{Host: "ctl1", Mode: "primary", Up: true},
+		{Host: "ctl2", Mode: "backup", Up: false},
+	}, ParseControllers([]byte("Slurmctld(primary/backup) at ctl1/ctl2 are UP/DOWN\n")))
+	assert.Equal(t, -1, ActiveController([]Controller{{Host: "ctl1", Mode: "primary"}}))
+}
+
+func TestControllersCollector(t *testing.T) {
+	runner := NewFakeRunner()
+	data := NewFakeRunner().File(t, "scontrol", "test_data/scontrol_ping.txt").Output["scontrol"]
+	// scontrol ping fails if a controller is down
+	runner.Errors["scontrol ping"] = &CommandError{Command: "scontrol", Args: []string{"ping"}, Err: errors.New("exit status 1"), Stdout: data}
+	collector := NewControllersCollector(NewSlurm(NewCommandSource(runner)))
+	expected := `
+# HELP slurm_controller_primary Whether the slurmctld currently serves the cluster, the first one responding
+# TYPE slurm_controller_primary gauge
+slurm_controller_primary{host="ctl1",mode="primary"} 0
+slurm_controller_primary{host="ctl2",mode="backup"} 1
+# HELP slurm_controller_up Whether the slurmctld responds to scontrol ping
+# TYPE slurm_controller_up gauge
+slurm_controller_up{host="ctl1",mode="primary"} 0
+slurm_controller_up{host="ctl2",mode="backup"} 1
+`
+	exporter := NewSlurmExporter(map[string]Collector{"controllers": collector})
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected),
+		"slurm_controller_primary", "slurm_controller_up", "slurm_controller_latency_seconds"); err != nil {
+		t.Error(err)
+	}
+}
@@ -17,12 +17,6 @@ package main
 
 import (
 	"github.com/prometheus/client_golang/prometheus"
-	"io/ioutil"
-	"log"
-	"os"
-	"os/exec"
-	"strconv"
-	"strings"
 )
 
 type CPUsMetrics struct {
@@ -32,48 +26,21 @@ type CPUsMetrics struct {
 	total float64
 }
 
-func CPUsGetMetrics() *CPUsMetrics {
-	return ParseCPUsMetrics(CPUsData())
-}
-
-func ParseCPUsMetrics(input []byte) *CPUsMetrics {
+// ParseCPUsMetrics sums up the CPUs of all nodes
+func ParseCPUsMetrics(nodes []Node) *CPUsMetrics {
 	var cm CPUsMetrics
-	if strings.Contains(string(input), "/") {
-		splitted := strings.Split(strings.TrimSpace(string(input)), "/")
-		cm.alloc, _ = strconv.ParseFloat(splitted[0], 64)
-		cm.idle, _ = strconv.ParseFloat(splitted[1], 64)
-		cm.other, _ = strconv.ParseFloat(splitted[2], 64)
-		cm.total, _ = strconv.ParseFloat(splitted[3], 64)
+	for _, node := range UniqueNodes(nodes) {
+		cm.alloc += node.CPUsAlloc
+		cm.idle += node.CPUsIdle
+		cm.other += node.CPUsOther
+		cm.total += node.CPUsTotal
 	}
 	return &cm
 }
 
-// Execute the sinfo command and return its output
-func CPUsData() []byte {
-	cmd := exec.Command("/usr/bin/sinfo", "-h", "-o %C")
-	cmd.Env = append(os.Environ(), "PATH=/usr/bin:/bin:/usr/sbin:/sbin")
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
-	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
-	}
-	out, _ := ioutil.ReadAll(stdout)
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
-	}
-	return out
-}
-
-/*
- * Implement the Prometheus Collector interface and feed the
- * Slurm scheduler metrics into it.
- * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
- */
-
-func NewCPUsCollector() *CPUsCollector {
+func NewCPUsCollector(slurm *Slurm) *CPUsCollector {
 	return &CPUsCollector{
+		slurm: slurm,
 		alloc: prometheus.NewDesc("slurm_cpus_alloc", "Allocated CPUs", nil, nil),
 		idle:  prometheus.NewDesc("slurm_cpus_idle", "Idle CPUs", nil, nil),
 		other: prometheus.NewDesc("slurm_cpus_other", "Mix CPUs", nil, nil),
@@ -82,6 +49,7 @@ func NewCPUsCollector() *CPUsCollector {
 }
 
 type CPUsCollector struct {
+	slurm *Slurm
 	alloc *prometheus.Desc
 	idle  *prometheus.Desc
 	other *prometheus.Desc
@@ -95,10 +63,15 @@ func (cc *CPUsCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- cc.other
 	ch <- cc.total
 }
-func (cc *CPUsCollector) Collect(ch chan<- prometheus.Metric) {
-	cm := CPUsGetMetrics()
+func (cc *CPUsCollector) Update(ch chan<- prometheus.Metric) error {
+	nodes, err := cc.slurm.Nodes()
+	if err != nil {
+		return err
+	}
+	cm := ParseCPUsMetrics(nodes)
 	ch <- prometheus.MustNewConstMetric(cc.alloc, prometheus.GaugeValue, cm.alloc)
 	ch <- prometheus.MustNewConstMetric(cc.idle, prometheus.GaugeValue, cm.idle)
 	ch <- prometheus.MustNewConstMetric(cc.other, prometheus.GaugeValue, cm.other)
 	ch <- prometheus.MustNewConstMetric(cc.total, prometheus.GaugeValue, cm.total)
+	return nil
 }
@@ -17,16 +17,40 @@ package main
 
 import (
 	"io/ioutil"
-	"os"
+	"strings"
 	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestCPUsMetrics(t *testing.T) {
 	// Read the input data from a file
-	file, err := os.Open("test_data/sinfo_cpus.txt")
+	data, err := ioutil.ReadFile("test_data/sinfo_nodes.txt")
 	if err != nil {
 		t.Fatalf("Can not open test data: %v", err)
 	}
-	data, err := ioutil.ReadAll(file)
-	t.Logf("%+v", ParseCPUsMetrics(data))
+	t.Logf("%+v", ParseCPUsMetrics(ParseNodeList(data)))
+}
+
+func TestCPUsCollector(t *testing.T) {
+	runner := NewFakeRunner().File(t, "sinfo", "test_data/sinfo_nodes.txt")
+	expected := `
+# HELP slurm_cpus_alloc Allocated CPUs
+# TYPE slurm_cpus_alloc gauge
+slurm_cpus_alloc 128
+# HELP slurm_cpus_idle Idle CPUs
+# TYPE slurm_cpus_idle gauge
+slurm_cpus_idle 96
+# HELP slurm_cpus_other Mix CPUs
+# TYPE slurm_cpus_other gauge
+slurm_cpus_other 64
+# HELP slurm_cpus_total Total CPUs
+# TYPE slurm_cpus_total gauge
+slurm_cpus_total 288
+`
+	exporter := NewSlurmExporter(map[string]Collector{"cpus": NewCPUsCollector(NewSlurm(NewCommandSource(runner)))})
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected),
+		"slurm_cpus_alloc", "slurm_cpus_idle", "slurm_cpus_other", "slurm_cpus_total"); err != nil {
+		t.Error(err)
+	}
 }
@@ -0,0 +1,112 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+/*
+ * Label filters drop series by the value of one of their labels, e.g. to
+ * hide the scratch partitions or the system users. Like the relabeling of
+ * Prometheus the regular expressions have to match the whole value. Series
+ * without the label are always kept.
+ */
+
+type LabelFilter struct {
+	Label string `yaml:"label"`
+	// Keep only the series whose label value matches
+	Keep string `yaml:"keep"`
+	// Drop the series whose label value matches
+	Drop string `yaml:"drop"`
+
+	keep *regexp.Regexp
+	drop *regexp.Regexp
+}
+
+func (f *LabelFilter) compile() error {
+	if f.Label == "" {
+		return fmt.Errorf("label filter without label")
+	}
+	var err error
+	if f.Keep != "" {
+		if f.keep, err = regexp.Compile("^(?:" + f.Keep + ")$"); err != nil {
+			return fmt.Errorf("label filter %s: %v", f.Label, err)
+		}
+	}
+	if f.Drop != "" {
+		if f.drop, err = regexp.Compile("^(?:" + f.Drop + ")$"); err != nil {
+			return fmt.Errorf("label filter %s: %v", f.Label, err)
+		}
+	}
+	return nil
+}
+
+// Whether to keep a series with the given labels
+func (f *LabelFilter) keeps(labels []*dto.LabelPair) bool {
+	for _, label := range labels {
+		if label.GetName() != f.Label {
+			continue
+		}
+		if f.keep != nil && !f.keep.MatchString(label.GetValue()) {
+			return false
+		}
+		if f.drop != nil && f.drop.MatchString(label.GetValue()) {
+			return false
+		}
+	}
+	return true
+}
+
+// filteredCollector passes on the metrics kept by all filters
+type filteredCollector struct {
+	prometheus.Collector
+	filters []*LabelFilter
+}
+
+func (c filteredCollector) Collect(ch chan<- prometheus.Metric) {
+	all := make(chan prometheus.Metric)
+	go func() {
+		c.Collector.Collect(all)
+		close(all)
+	}()
+	for m := range all {
+		var metric dto.Metric
+		if err := m.Write(&metric); err != nil {
+			ch <- m
+			continue
+		}
+		keep := true
+		for _, f := range c.filters {
+			keep = keep && f.keeps(metric.Label)
+		}
+		if keep {
+			ch <- m
+		}
+	}
+}
+
+// Apply the filters to the metrics of a collector
+func filterCollector(c prometheus.Collector, filters []*LabelFilter) prometheus.Collector {
+	if len(filters) == 0 {
+		return c
+	}
+	return filteredCollector{c, filters}
+}
@@ -0,0 +1,51 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLabelFilters(t *testing.T) {
+	runner := NewFakeRunner().File(t, "sinfo", "test_data/sinfo_nodes.txt").File(t, "squeue", "test_data/squeue.txt")
+	cluster, err := NewCluster("", NewCommandSource(runner), []string{"partitions"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster.Filters = []*LabelFilter{
+		{Label: "partition", Drop: "gpu|lon"},
+		{Label: "partition", Keep: "[a-z]+"},
+	}
+	for _, f := range cluster.Filters {
+		if err := f.compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// "lon" does not match the whole name of the long partition
+	expected := `
+# HELP slurm_partition_cpus_total Total CPUs for partition
+# TYPE slurm_partition_cpus_total gauge
+slurm_partition_cpus_total{partition="long"} 96
+slurm_partition_cpus_total{partition="normal"} 96
+`
+	if err := testutil.CollectAndCompare(cluster.exporter(cluster.Collectors), strings.NewReader(expected),
+		"slurm_partition_cpus_total"); err != nil {
+		t.Error(err)
+	}
+}
@@ -17,12 +17,8 @@ package main
 
 import (
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
-	"io/ioutil"
-	"os"
-	"os/exec"
-	"strings"
 	"strconv"
+	"strings"
 )
 
 type GPUsMetrics struct {
@@ -32,99 +28,187 @@ type GPUsMetrics struct {
 	utilization float64
 }
 
-func GPUsGetMetrics() *GPUsMetrics {
-	return ParseGPUsMetrics()
-}
+// Sources of the number of allocated GPUs, the generic resources in use on
+// the nodes or the running jobs in the accounting database
+const (
+	GPUsAllocGres  = "gres"
+	GPUsAllocSacct = "sacct"
+)
 
-func ParseAllocatedGPUs() float64 {
+// ParseAllocatedGPUs sums up the GPUs allocated to the running jobs with
+// sacct, which requires SlurmDBD
+func ParseAllocatedGPUs(runner Runner) (float64, error) {
 	var num_gpus = 0.0
 
 	args := []string{"-a", "-X", "--format=AllocTRES", "--state=RUNNING", "--noheader", "--parsable2"}
-	output := string(Execute("/usr/bin/sacct", args))
-	if len(output) > 0 {
-		for _, line := range strings.Split(output, "\n") {
-			if len(line) > 0 {
-				line = strings.Trim(line, "\"")
-				descriptor := strings.TrimPrefix(line, "gpu:")
-				job_gpus, _ := strconv.ParseFloat(descriptor, 64)
-				num_gpus += job_gpus
-			}
+	out, err := runner.Run("sacct", args...)
+	if err != nil {
+		return 0, err
+	}
+	// Every line lists the TRES of a job, e.g. billing=4,cpu=4,gres/gpu=1,mem=16G
+	for _, line := range strings.Split(string(out), "\n") {
+		num_gpus += ParseTRES(strings.Trim(line, "\""))["gres/gpu"]
+	}
+
+	return num_gpus, nil
+}
+
+// GresCount returns the number of generic resources of the given name in
+// a Gres string of sinfo, e.g. "gpu:tesla:4(S:0-1),mps:400"
+func GresCount(gres string, name string) float64 {
+	var count float64
+	for _, entry := range strings.Split(stripParentheses(gres), ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+		if parts[0] != name || len(parts) < 2 {
+			continue
+		}
+		value, _ := strconv.ParseFloat(parts[len(parts)-1], 64)
+		count += value
+	}
+	return count
+}
+
+// GresTypeCount returns the number of generic resources of the given name
+// per type, e.g. {"a100": 2, "v100": 1} of "gpu:a100:2(S:0),gpu:v100:1".
+// Resources without a type are counted with an empty type.
+func GresTypeCount(gres string, name string) map[string]float64 {
+	counts := make(map[string]float64)
+	for _, entry := range strings.Split(stripParentheses(gres), ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+		if parts[0] != name || len(parts) < 2 {
+			continue
+		}
+		value, _ := strconv.ParseFloat(parts[len(parts)-1], 64)
+		gresType := strings.Join(parts[1:len(parts)-1], ":")
+		if gresType == "(null)" {
+			gresType = ""
 		}
+		counts[gresType] += value
 	}
+	return counts
+}
+
+// Remove the socket or index lists in parentheses, they may contain commas
+func stripParentheses(s string) string {
+	var b strings.Builder
+	depth := 0
+	for _, r := range s {
+		switch {
+		case r == '(':
+			depth++
+		case r == ')' && depth > 0:
+			depth--
+		case depth == 0:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
 
+func ParseTotalGPUs(nodes []Node) float64 {
+	var num_gpus = 0.0
+	for _, node := range UniqueNodes(nodes) {
+		num_gpus += GresCount(node.Gres, "gpu")
+	}
 	return num_gpus
 }
 
-func ParseTotalGPUs() float64 {
+// ParseUsedGPUs sums up the GPUs in use on the nodes
+func ParseUsedGPUs(nodes []Node) float64 {
 	var num_gpus = 0.0
+	for _, node := range UniqueNodes(nodes) {
+		num_gpus += GresCount(node.GresUsed, "gpu")
+	}
+	return num_gpus
+}
+
+// GPUs of a node or partition by type
+type GPUTypeMetrics struct {
+	alloc float64
+	total float64
+}
 
-	args := []string{"-h", "-o \"%n %G\""}
-	output := string(Execute("/usr/bin/sinfo", args))
-	if len(output) > 0 {
-		for _, line := range strings.Split(output, "\n") {
-			if len(line) > 0 {
-				line = strings.Trim(line, "\"")
-				descriptor := strings.Fields(line)[1]
-				descriptor = strings.TrimPrefix(descriptor, "gpu:")
-				descriptor = strings.Split(descriptor, "(")[0]
-				node_gpus, _ :=  strconv.ParseFloat(descriptor, 64)
-				num_gpus += node_gpus
+// ParseGPUTypeMetrics returns the GPUs per type of every node and of every
+// partition from the generic resources configured and in use on the nodes
+func ParseGPUTypeMetrics(nodes []Node) (byNode, byPartition map[string]map[string]*GPUTypeMetrics) {
+	add := func(m map[string]map[string]*GPUTypeMetrics, key string, node Node) {
+		for gpuType, total := range GresTypeCount(node.Gres, "gpu") {
+			if _, ok := m[key]; !ok {
+				m[key] = make(map[string]*GPUTypeMetrics)
+			}
+			if _, ok := m[key][gpuType]; !ok {
+				m[key][gpuType] = &GPUTypeMetrics{}
+			}
+			m[key][gpuType].total += total
+		}
+		for gpuType, alloc := range GresTypeCount(node.GresUsed, "gpu") {
+			if t, ok := m[key][gpuType]; ok {
+				t.alloc += alloc
 			}
 		}
 	}
-
-	return num_gpus
+	byNode = make(map[string]map[string]*GPUTypeMetrics)
+	for _, node := range UniqueNodes(nodes) {
+		add(byNode, node.Name, node)
+	}
+	byPartition = make(map[string]map[string]*GPUTypeMetrics)
+	for _, node := range nodes {
+		add(byPartition, node.Partition, node)
+	}
+	return byNode, byPartition
 }
 
-func ParseGPUsMetrics() *GPUsMetrics {
+func ParseGPUsMetrics(slurm *Slurm, allocation string) (*GPUsMetrics, error) {
 	var gm GPUsMetrics
-	total_gpus := ParseTotalGPUs()
-	allocated_gpus := ParseAllocatedGPUs()
+	nodes, err := slurm.Nodes()
+	if err != nil {
+		return nil, err
+	}
+	total_gpus := ParseTotalGPUs(nodes)
+	allocated_gpus := ParseUsedGPUs(nodes)
+	if allocation == GPUsAllocSacct {
+		if allocated_gpus, err = slurm.AllocatedGPUs(); err != nil {
+			return nil, err
+		}
+	}
 	gm.alloc = allocated_gpus
 	gm.idle = total_gpus - allocated_gpus
 	gm.total = total_gpus
 	gm.utilization = allocated_gpus / total_gpus
-	return &gm
-}
-
-// Execute the sinfo command and return its output
-func Execute(command string, arguments []string) []byte {
-	cmd := exec.Command(command, arguments...)
-	cmd.Env = append(os.Environ(), "PATH=/usr/bin:/bin:/usr/sbin:/sbin")
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
-	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
-	}
-	out, _ := ioutil.ReadAll(stdout)
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
-	}
-	return out
+	return &gm, nil
 }
 
-/*
- * Implement the Prometheus Collector interface and feed the
- * Slurm scheduler metrics into it.
- * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
- */
-
-func NewGPUsCollector() *GPUsCollector {
+func NewGPUsCollector(slurm *Slurm) *GPUsCollector {
 	return &GPUsCollector{
-		alloc: prometheus.NewDesc("slurm_gpus_alloc", "Allocated GPUs", nil, nil),
-		idle:  prometheus.NewDesc("slurm_gpus_idle", "Idle GPUs", nil, nil),
-		total: prometheus.NewDesc("slurm_gpus_total", "Total GPUs", nil, nil),
-		utilization: prometheus.NewDesc("slurm_gpus_utilization", "Total GPU utilization", nil, nil),
+		slurm:          slurm,
+		alloc:          prometheus.NewDesc("slurm_gpus_alloc", "Allocated GPUs", nil, nil),
+		idle:           prometheus.NewDesc("slurm_gpus_idle", "Idle GPUs", nil, nil),
+		total:          prometheus.NewDesc("slurm_gpus_total", "Total GPUs", nil, nil),
+		utilization:    prometheus.NewDesc("slurm_gpus_utilization", "Total GPU utilization", nil, nil),
+		nodeAlloc:      prometheus.NewDesc("slurm_node_gpus_alloc", "Allocated GPUs per node and type", []string{"node", "type"}, nil),
+		nodeTotal:      prometheus.NewDesc("slurm_node_gpus_total", "Total GPUs per node and type", []string{"node", "type"}, nil),
+		partitionAlloc: prometheus.NewDesc("slurm_partition_gpus_alloc", "Allocated GPUs per partition and type", []string{"partition", "type"}, nil),
+		partitionTotal: prometheus.NewDesc("slurm_partition_gpus_total", "Total GPUs per partition and type", []string{"partition", "type"}, nil),
 	}
 }
 
 type GPUsCollector struct {
+	slurm *Slurm
+	// Source of the allocated GPUs, GPUsAllocGres or GPUsAllocSacct
+	Allocation  string
 	alloc       *prometheus.Desc
 	idle        *prometheus.Desc
 	total       *prometheus.Desc
 	utilization *prometheus.Desc
+	// GPUs by type from the generic resources of the nodes
+	nodeAlloc      *prometheus.Desc
+	nodeTotal      *prometheus.Desc
+	partitionAlloc *prometheus.Desc
+	partitionTotal *prometheus.Desc
+}
+
+func (cc *GPUsCollector) configure(config *Config) {
+	cc.Allocation = config.GPUs.Allocation
 }
 
 // Send all metric descriptions
@@ -133,11 +217,36 @@ func (cc *GPUsCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- cc.idle
 	ch <- cc.total
 	ch <- cc.utilization
+	ch <- cc.nodeAlloc
+	ch <- cc.nodeTotal
+	ch <- cc.partitionAlloc
+	ch <- cc.partitionTotal
 }
-func (cc *GPUsCollector) Collect(ch chan<- prometheus.Metric) {
-	cm := GPUsGetMetrics()
+func (cc *GPUsCollector) Update(ch chan<- prometheus.Metric) error {
+	cm, err := ParseGPUsMetrics(cc.slurm, cc.Allocation)
+	if err != nil {
+		return err
+	}
+	nodes, err := cc.slurm.Nodes()
+	if err != nil {
+		return err
+	}
 	ch <- prometheus.MustNewConstMetric(cc.alloc, prometheus.GaugeValue, cm.alloc)
 	ch <- prometheus.MustNewConstMetric(cc.idle, prometheus.GaugeValue, cm.idle)
 	ch <- prometheus.MustNewConstMetric(cc.total, prometheus.GaugeValue, cm.total)
 	ch <- prometheus.MustNewConstMetric(cc.utilization, prometheus.GaugeValue, cm.utilization)
+	byNode, byPartition := ParseGPUTypeMetrics(nodes)
+	for node, types := range byNode {
+		for gpuType, m := range types {
+			ch <- prometheus.MustNewConstMetric(cc.nodeAlloc, prometheus.GaugeValue, m.alloc, node, gpuType)
+			ch <- prometheus.MustNewConstMetric(cc.nodeTotal, prometheus.GaugeValue, m.total, node, gpuType)
+		}
+	}
+	for partition, types := range byPartition {
+		for gpuType, m := range types {
+			ch <- prometheus.MustNewConstMetric(cc.partitionAlloc, prometheus.GaugeValue, m.alloc, partition, gpuType)
+			ch <- prometheus.MustNewConstMetric(cc.partitionTotal, prometheus.GaugeValue, m.total, partition, gpuType)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,99 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGresCount(t *testing.T) {
+	assert.Equal(t, 4.0, GresCount("gpu:4", "gpu"))
+	assert.Equal(t, 4.0, GresCount("gpu:tesla:4(S:0-1)", "gpu"))
+	assert.Equal(t, 3.0, GresCount("gpu:a100:2(S:0,1),gpu:v100:1(S:1),mps:200", "gpu"))
+	assert.Equal(t, 200.0, GresCount("gpu:a100:2(S:0,1),gpu:v100:1(S:1),mps:200", "mps"))
+	assert.Equal(t, 0.0, GresCount("(null)", "gpu"))
+}
+
+func TestTotalGPUs(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sinfo_nodes.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	assert.Equal(t, 10.0, ParseTotalGPUs(ParseNodeList(data)))
+}
+
+func TestGresTypeCount(t *testing.T) {
+	assert.Equal(t, map[string]float64{"": 4}, GresTypeCount("gpu:4", "gpu"))
+	assert.Equal(t, map[string]float64{"a100": 4}, GresTypeCount("gpu:a100:4(S:0-1)", "gpu"))
+	assert.Equal(t, map[string]float64{"a100": 2, "v100": 1}, GresTypeCount("gpu:a100:2(S:0,1),gpu:v100:1(S:1),mps:200", "gpu"))
+	assert.Equal(t, map[string]float64{"1g.5gb": 7, "3g.20gb": 2}, GresTypeCount("gpu:1g.5gb:7,gpu:3g.20gb:2", "gpu"))
+	assert.Equal(t, map[string]float64{"": 0}, GresTypeCount("gpu:(null):0", "gpu"))
+}
+
+func TestGPUTypeMetrics(t *testing.T) {
+	runner := NewFakeRunner().File(t, "sinfo", "test_data/sinfo_nodes.txt")
+	collector := NewGPUsCollector(NewSlurm(NewCommandSource(runner)))
+	expected := `
+# HELP slurm_node_gpus_alloc Allocated GPUs per node and type
+# TYPE slurm_node_gpus_alloc gauge
+slurm_node_gpus_alloc{node="g001",type="a100"} 2
+slurm_node_gpus_alloc{node="g002",type="a100"} 4
+slurm_node_gpus_alloc{node="g003",type="v100"} 0
+# HELP slurm_partition_gpus_alloc Allocated GPUs per partition and type
+# TYPE slurm_partition_gpus_alloc gauge
+slurm_partition_gpus_alloc{partition="gpu",type="a100"} 6
+slurm_partition_gpus_alloc{partition="gpu",type="v100"} 0
+# HELP slurm_partition_gpus_total Total GPUs per partition and type
+# TYPE slurm_partition_gpus_total gauge
+slurm_partition_gpus_total{partition="gpu",type="a100"} 8
+slurm_partition_gpus_total{partition="gpu",type="v100"} 2
+`
+	exporter := NewSlurmExporter(map[string]Collector{"gpus": collector})
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected),
+		"slurm_node_gpus_alloc", "slurm_partition_gpus_alloc", "slurm_partition_gpus_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGPUsAllocation(t *testing.T) {
+	runner := NewFakeRunner().File(t, "sinfo", "test_data/sinfo_nodes.txt")
+	runner.Output["sacct"] = []byte("billing=8,cpu=8,gres/gpu=5,mem=32G,node=2\n")
+	collector := NewGPUsCollector(NewSlurm(NewCommandSource(runner)))
+	exporter := NewSlurmExporter(map[string]Collector{"gpus": collector})
+	expected := `
+# HELP slurm_gpus_alloc Allocated GPUs
+# TYPE slurm_gpus_alloc gauge
+slurm_gpus_alloc %d
+`
+	// The GPUs in use on the nodes, without querying the accounting database
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(fmt.Sprintf(expected, 6)), "slurm_gpus_alloc"); err != nil {
+		t.Error(err)
+	}
+	for _, call := range runner.Calls {
+		assert.False(t, strings.HasPrefix(call, "sacct"), call)
+	}
+	collector.Allocation = GPUsAllocSacct
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(fmt.Sprintf(expected, 5)), "slurm_gpus_alloc"); err != nil {
+		t.Error(err)
+	}
+}
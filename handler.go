@@ -0,0 +1,71 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+/*
+ * MetricsHandler serves the metrics of all enabled collectors. A scrape can
+ * select a subset of them with the collect[] URL parameter, for example
+ * /metrics?collect[]=scheduler&collect[]=partitions, in which case only
+ * those collectors run (on every cluster) and a fresh registry is used for
+ * the request.
+ */
+
+type MetricsHandler struct {
+	clusters   []*Cluster
+	unfiltered http.Handler
+}
+
+func NewMetricsHandler(clusters []*Cluster, unfiltered http.Handler) *MetricsHandler {
+	return &MetricsHandler{
+		clusters:   clusters,
+		unfiltered: unfiltered,
+	}
+}
+
+func (h *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	filters := r.URL.Query()["collect[]"]
+	if len(filters) == 0 {
+		h.unfiltered.ServeHTTP(w, r)
+		return
+	}
+	registry := prometheus.NewRegistry()
+	for _, cluster := range h.clusters {
+		filtered := make(map[string]Collector)
+		for _, name := range filters {
+			c, ok := cluster.Collectors[name]
+			if !ok {
+				http.Error(w, fmt.Sprintf("collector %q is unknown or not enabled", name), http.StatusBadRequest)
+				return
+			}
+			filtered[name] = c
+		}
+		if err := cluster.registerer(registry).Register(cluster.exporter(filtered)); err != nil {
+			http.Error(w, fmt.Sprintf("could not create registry: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{
+		ErrorHandling: promhttp.ContinueOnError,
+	}).ServeHTTP(w, r)
+}
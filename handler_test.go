@@ -0,0 +1,54 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsHandlerFilter(t *testing.T) {
+	runner := NewFakeRunner().File(t, "sinfo", "test_data/sinfo_nodes.txt").File(t, "sdiag", "test_data/sdiag.txt")
+	cluster, err := NewCluster("", NewCommandSource(runner), []string{"cpus", "scheduler"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unfiltered := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("unfiltered"))
+	})
+	handler := NewMetricsHandler([]*Cluster{cluster}, unfiltered)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics?collect[]=scheduler", nil))
+	body, _ := ioutil.ReadAll(rec.Body)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, string(body), `slurm_exporter_collector_success{collector="scheduler"} 1`)
+	assert.Contains(t, string(body), "slurm_scheduler_threads 3")
+	assert.NotContains(t, string(body), "slurm_cpus_total")
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics?collect[]=queue", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ = ioutil.ReadAll(rec.Body)
+	assert.Equal(t, "unfiltered", string(body))
+}
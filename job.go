@@ -0,0 +1,124 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/*
+ * The JobCollector exposes the requested resources and times of every
+ * single job, e.g. to see which jobs are using a full cluster. It creates
+ * several series per job and is disabled by default, Limit restricts it to
+ * the jobs requesting the most resources.
+ */
+
+type JobCollector struct {
+	slurm *Slurm
+	// Number of jobs exposed, 0 exposes all jobs
+	Limit     int
+	cpus      *prometheus.Desc
+	memory    *prometheus.Desc
+	nodes     *prometheus.Desc
+	gpus      *prometheus.Desc
+	timeLimit *prometheus.Desc
+	elapsed   *prometheus.Desc
+	submit    *prometheus.Desc
+	start     *prometheus.Desc
+	omitted   *prometheus.Desc
+}
+
+func NewJobCollector(slurm *Slurm) *JobCollector {
+	labels := []string{"job_id", "name", "user", "account", "partition", "qos", "state"}
+	return &JobCollector{
+		slurm:     slurm,
+		cpus:      prometheus.NewDesc("slurm_job_cpus", "CPUs requested by the job", labels, nil),
+		memory:    prometheus.NewDesc("slurm_job_memory_bytes", "Memory requested by the job", labels, nil),
+		nodes:     prometheus.NewDesc("slurm_job_nodes", "Nodes requested by the job", labels, nil),
+		gpus:      prometheus.NewDesc("slurm_job_gpus", "GPUs requested by the job", labels, nil),
+		timeLimit: prometheus.NewDesc("slurm_job_time_limit_seconds", "Time limit of the job", labels, nil),
+		elapsed:   prometheus.NewDesc("slurm_job_elapsed_seconds", "Time the job has been running", labels, nil),
+		submit:    prometheus.NewDesc("slurm_job_submit_time_seconds", "Time when the job was submitted", labels, nil),
+		start:     prometheus.NewDesc("slurm_job_start_time_seconds", "Time when the job started", labels, nil),
+		omitted:   prometheus.NewDesc("slurm_jobs_omitted", "Jobs not exposed because of the limit of the jobs collector", nil, nil),
+	}
+}
+
+func (jc *JobCollector) configure(config *Config) {
+	jc.Limit = config.Jobs.Limit
+}
+
+// Send all metric descriptions
+func (jc *JobCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- jc.cpus
+	ch <- jc.memory
+	ch <- jc.nodes
+	ch <- jc.gpus
+	ch <- jc.timeLimit
+	ch <- jc.elapsed
+	ch <- jc.submit
+	ch <- jc.start
+	ch <- jc.omitted
+}
+
+// TopJobs returns the limit jobs requesting the most GPUs, then CPUs, then
+// memory, all jobs if limit is 0
+func TopJobs(jobs []Job, limit int) []Job {
+	if limit <= 0 || len(jobs) <= limit {
+		return jobs
+	}
+	sorted := append([]Job(nil), jobs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.GPUs != b.GPUs {
+			return a.GPUs > b.GPUs
+		}
+		if a.CPUs != b.CPUs {
+			return a.CPUs > b.CPUs
+		}
+		return a.Memory > b.Memory
+	})
+	return sorted[:limit]
+}
+
+func (jc *JobCollector) Update(ch chan<- prometheus.Metric) error {
+	jobs, err := jc.slurm.Jobs()
+	if err != nil {
+		return err
+	}
+	top := TopJobs(jobs, jc.Limit)
+	for _, job := range top {
+		labels := []string{job.ID, job.Name, job.User, job.Account, job.Partition, job.QOS, job.State}
+		ch <- prometheus.MustNewConstMetric(jc.cpus, prometheus.GaugeValue, job.CPUs, labels...)
+		ch <- prometheus.MustNewConstMetric(jc.memory, prometheus.GaugeValue, job.Memory, labels...)
+		ch <- prometheus.MustNewConstMetric(jc.nodes, prometheus.GaugeValue, job.Nodes, labels...)
+		ch <- prometheus.MustNewConstMetric(jc.gpus, prometheus.GaugeValue, job.GPUs, labels...)
+		if job.TimeLimit > 0 {
+			ch <- prometheus.MustNewConstMetric(jc.timeLimit, prometheus.GaugeValue, job.TimeLimit, labels...)
+		}
+		ch <- prometheus.MustNewConstMetric(jc.elapsed, prometheus.GaugeValue, job.Elapsed, labels...)
+		if !job.SubmitTime.IsZero() {
+			ch <- prometheus.MustNewConstMetric(jc.submit, prometheus.GaugeValue, float64(job.SubmitTime.Unix()), labels...)
+		}
+		if !job.StartTime.IsZero() {
+			ch <- prometheus.MustNewConstMetric(jc.start, prometheus.GaugeValue, float64(job.StartTime.Unix()), labels...)
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(jc.omitted, prometheus.GaugeValue, float64(len(jobs)-len(top)))
+	return nil
+}
@@ -0,0 +1,47 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestJobCollectorLimit(t *testing.T) {
+	runner := NewFakeRunner().File(t, "squeue", "test_data/squeue.txt")
+	collector := NewJobCollector(NewSlurm(NewCommandSource(runner)))
+	collector.Limit = 2
+	expected := `
+# HELP slurm_job_gpus GPUs requested by the job
+# TYPE slurm_job_gpus gauge
+slurm_job_gpus{account="chemistry",job_id="15452423",name="md-water|v2",partition="long",qos="low",state="PENDING",user="bar"} 1
+slurm_job_gpus{account="chemistry",job_id="15452443",name="md-water",partition="long",qos="low",state="RUNNING",user="bar"} 4
+# HELP slurm_job_time_limit_seconds Time limit of the job
+# TYPE slurm_job_time_limit_seconds gauge
+slurm_job_time_limit_seconds{account="chemistry",job_id="15452423",name="md-water|v2",partition="long",qos="low",state="PENDING",user="bar"} 7200
+slurm_job_time_limit_seconds{account="chemistry",job_id="15452443",name="md-water",partition="long",qos="low",state="RUNNING",user="bar"} 7200
+# HELP slurm_jobs_omitted Jobs not exposed because of the limit of the jobs collector
+# TYPE slurm_jobs_omitted gauge
+slurm_jobs_omitted 40
+`
+	exporter := NewSlurmExporter(map[string]Collector{"jobs": collector})
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected),
+		"slurm_job_gpus", "slurm_job_time_limit_seconds", "slurm_jobs_omitted"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,220 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * A single squeue call lists all jobs with every attribute needed by the
+ * queue, accounts, users, partitions and jobs collectors. The output is parsed
+ * once into a list of jobs shared by those collectors.
+ */
+
+// Job holds the attributes of a single job (or job array task)
+type Job struct {
+	ID        string
+	State     string
+	CPUs      float64
+	Partition string
+	User      string
+	Account   string
+	QOS       string
+	Reason    string
+	Name      string
+	// Requested resources, memory in bytes
+	Nodes  float64
+	Memory float64
+	GPUs   float64
+	// Generic resources requested per node, e.g. gpu:a100:2
+	Gres string
+	// Trackable resources, squeue -O lists the requested ones of pending
+	// jobs and the allocated ones of the others
+	ReqTRES   TRES
+	AllocTRES TRES
+	// Time limit and elapsed time in seconds, zero if not set
+	TimeLimit float64
+	Elapsed   float64
+	// Start time is zero for pending jobs
+	SubmitTime time.Time
+	StartTime  time.Time
+}
+
+// Fields of the squeue output, each padded to the given width and
+// terminated by "|" like the sinfo output. The name may contain "|" and has
+// to come last. MinMemory is per CPU for jobs requesting memory with
+// --mem-per-cpu, the memory of the TRES is the total of the job.
+var squeueFormat = strings.Join([]string{
+	"JobArrayID:64|",
+	"State:32|",
+	"NumCPUs:16|",
+	"Partition:64|",
+	"UserName:64|",
+	"Account:64|",
+	"QOS:64|",
+	"NumNodes:16|",
+	"MinMemory:20|",
+	"tres-per-node:256|",
+	"TimeLimit:20|",
+	"TimeUsed:20|",
+	"SubmitTime:32|",
+	"StartTime:32|",
+	"tres-alloc:512|",
+	"Reason:64|",
+	"Name:256|",
+}, ",")
+
+const squeueFields = 17
+
+// Execute the squeue command and return its output
+func JobsData(runner Runner) ([]byte, error) {
+	return runner.Run("squeue", "-a", "-r", "-h", "-O", squeueFormat)
+}
+
+// ParseJobs extracts the list of jobs from the squeue output
+func ParseJobs(input []byte) []Job {
+	var jobs []Job
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := strings.SplitN(line, "|", squeueFields)
+		if len(fields) < squeueFields {
+			continue
+		}
+		fields[squeueFields-1] = strings.TrimSuffix(strings.TrimSpace(fields[squeueFields-1]), "|")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		cpus, _ := strconv.ParseFloat(fields[2], 64)
+		nodes, _ := strconv.ParseFloat(fields[7], 64)
+		job := Job{
+			ID:         fields[0],
+			State:      fields[1],
+			CPUs:       cpus,
+			Partition:  fields[3],
+			User:       fields[4],
+			Account:    fields[5],
+			QOS:        fields[6],
+			Nodes:      nodes,
+			Memory:     ParseMemory(fields[8]) * nodes,
+			Gres:       jobGres(fields[9]),
+			TimeLimit:  ParseDuration(fields[10]),
+			Elapsed:    ParseDuration(fields[11]),
+			SubmitTime: parseTime(fields[12]),
+			Reason:     fields[15],
+			Name:       fields[16],
+		}
+		// The TRES of pending jobs are the requested ones
+		tres := ParseTRES(fields[14])
+		if job.State == "PENDING" {
+			job.ReqTRES = tres
+		} else {
+			job.AllocTRES = tres
+		}
+		if mem, ok := tres["mem"]; ok {
+			job.Memory = mem
+		}
+		job.GPUs = GresCount(job.Gres, "gpu") * nodes
+		// squeue prints the expected start time of pending jobs
+		if job.State != "PENDING" {
+			job.StartTime = parseTime(fields[13])
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+// Generic resources from the TRES per node, e.g. gpu:a100:1 of
+// gres/gpu:a100:1 or gres:gpu:a100:1
+func jobGres(tres string) string {
+	if tres == "N/A" {
+		return ""
+	}
+	tres = strings.Replace(tres, "gres:", "", -1)
+	return strings.Replace(tres, "gres/", "", -1)
+}
+
+// ParseDuration converts a Slurm time, e.g. 30:00, 2:00:00 or 1-12:00:00,
+// into seconds. UNLIMITED and unset times are zero.
+func ParseDuration(s string) float64 {
+	var days float64
+	hasDays := false
+	if i := strings.Index(s, "-"); i >= 0 {
+		hasDays = true
+		d, err := strconv.ParseFloat(s[:i], 64)
+		if err != nil {
+			return 0
+		}
+		days, s = d, s[i+1:]
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return 0
+	}
+	var seconds float64
+	for _, part := range parts {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0
+		}
+		seconds = seconds*60 + v
+	}
+	// Like the Slurm options, a single number is minutes, or hours after
+	// days, and two numbers are minutes:seconds, or hours:minutes after days
+	switch {
+	case len(parts) == 1 && hasDays:
+		seconds *= 3600
+	case len(parts) == 1, len(parts) == 2 && hasDays:
+		seconds *= 60
+	}
+	return days*86400 + seconds
+}
+
+// ParseMemory converts a Slurm memory size into bytes, sizes without a
+// unit are in megabytes
+func ParseMemory(s string) float64 {
+	units := map[byte]float64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40, 'P': 1 << 50}
+	unit := float64(1 << 20)
+	if len(s) > 0 {
+		if u, ok := units[s[len(s)-1]]; ok {
+			unit, s = u, s[:len(s)-1]
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0
+	}
+	return v * unit
+}
+
+// Times are printed by the Slurm commands in the local time zone, N/A and
+// Unknown are returned as zero time
+func parseTime(s string) time.Time {
+	t, err := time.ParseInLocation("2006-01-02T15:04:05", s, time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+func JobsGetMetrics(runner Runner) ([]Job, error) {
+	data, err := JobsData(runner)
+	if err != nil {
+		return nil, err
+	}
+	return ParseJobs(data), nil
+}
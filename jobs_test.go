@@ -0,0 +1,153 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// Format the fields of a job like squeue, each padded to its width
+func squeueLine(fields ...string) string {
+	var line string
+	for i, field := range strings.Split(squeueFormat, ",") {
+		width, _ := strconv.Atoi(strings.TrimSuffix(field[strings.Index(field, ":")+1:], "|"))
+		line += fmt.Sprintf("%-*s|", width, fields[i])
+	}
+	return line + "\n"
+}
+
+// Change the fields of a job in the squeue output
+func changeJob(output []byte, id string, change func(fields []string)) []byte {
+	lines := strings.SplitAfter(string(output), "\n")
+	for i, line := range lines {
+		fields := strings.SplitN(strings.TrimSuffix(line, "\n"), "|", squeueFields)
+		if len(fields) < squeueFields || strings.TrimSpace(fields[0]) != id {
+			continue
+		}
+		fields[squeueFields-1] = strings.TrimSuffix(strings.TrimSpace(fields[squeueFields-1]), "|")
+		for j := range fields {
+			fields[j] = strings.TrimSpace(fields[j])
+		}
+		change(fields)
+		lines[i] = squeueLine(fields...)
+	}
+	return []byte(strings.Join(lines, ""))
+}
+
+func TestParseJobs(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/squeue.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	jobs := ParseJobs(data)
+	assert.Equal(t, 42, len(jobs))
+	assert.Equal(t, Job{
+		ID:         "15452423",
+		State:      "PENDING",
+		CPUs:       12,
+		Partition:  "long",
+		User:       "bar",
+		Account:    "chemistry",
+		QOS:        "low",
+		Reason:     "Licenses",
+		Name:       "md-water|v2",
+		Nodes:      1,
+		Memory:     8 << 30,
+		GPUs:       1,
+		Gres:       "gpu:a100:1",
+		ReqTRES:    TRES{"billing": 12, "cpu": 12, "gres/gpu": 1, "gres/gpu:a100": 1, "mem": 8 << 30, "node": 1},
+		TimeLimit:  7200,
+		SubmitTime: time.Date(2021, 3, 1, 8, 31, 0, 0, time.Local),
+	}, jobs[31])
+	// Running job on two nodes
+	assert.Equal(t, "15452443", jobs[23].ID)
+	assert.Equal(t, 4.0, jobs[23].GPUs)
+	// Memory requested per CPU, the total is taken from the TRES
+	assert.Equal(t, float64(24<<30), jobs[23].Memory)
+	assert.Equal(t, TRES{"billing": 12, "cpu": 12, "gres/gpu": 4, "mem": 24 << 30, "node": 2}, jobs[23].AllocTRES)
+	assert.Equal(t, 5400.0, jobs[23].Elapsed)
+	assert.Equal(t, time.Date(2021, 3, 1, 8, 33, 0, 0, time.Local), jobs[23].StartTime)
+}
+
+func TestParseDuration(t *testing.T) {
+	for s, seconds := range map[string]float64{
+		"0:05":       5,
+		"30:00":      1800,
+		"2:00:00":    7200,
+		"1-00:00:00": 86400,
+		"2-12":       216000,
+		"1-0:30":     88200,
+		"60":         3600,
+		"UNLIMITED":  0,
+		"NOT_SET":    0,
+	} {
+		assert.Equal(t, seconds, ParseDuration(s), s)
+	}
+}
+
+func TestParseMemory(t *testing.T) {
+	for s, bytes := range map[string]float64{
+		"4000M": 4000 << 20,
+		"8G":    8 << 30,
+		"1T":    1 << 40,
+		"512":   512 << 20,
+		"0":     0,
+		"N/A":   0,
+	} {
+		assert.Equal(t, bytes, ParseMemory(s), s)
+	}
+}
+
+func TestJobsSharedBetweenCollectors(t *testing.T) {
+	runner := NewFakeRunner().File(t, "squeue", "test_data/squeue.txt")
+	runner.File(t, "sinfo", "test_data/sinfo_nodes.txt")
+	collectors, err := NewCollectors(NewCommandSource(runner), []string{"accounts", "partitions", "queue", "users"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := NewSlurmExporter(collectors)
+	expected := `
+# HELP slurm_account_jobs_pending Pending jobs for account
+# TYPE slurm_account_jobs_pending gauge
+slurm_account_jobs_pending{account="chemistry"} 4
+# HELP slurm_partition_jobs_pending Pending jobs for partition
+# TYPE slurm_partition_jobs_pending gauge
+slurm_partition_jobs_pending{partition="long"} 4
+# HELP slurm_user_jobs_running Running jobs for user
+# TYPE slurm_user_jobs_running gauge
+slurm_user_jobs_running{user="bar"} 9
+slurm_user_jobs_running{user="foo"} 19
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected),
+		"slurm_account_jobs_pending", "slurm_partition_jobs_pending", "slurm_user_jobs_running"); err != nil {
+		t.Error(err)
+	}
+	squeue := 0
+	for _, call := range runner.Calls {
+		if strings.HasPrefix(call, "squeue") {
+			squeue++
+		}
+	}
+	assert.Equal(t, 1, squeue)
+}
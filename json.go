@@ -0,0 +1,570 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Decoders of the JSON data model of Slurm, shared by the REST API of
+ * slurmrestd and the --json output of the Slurm commands. Older versions
+ * report plain numbers and strings where newer versions use objects and
+ * lists, both variants are accepted.
+ */
+
+// Errors reported in the JSON output
+type jsonErrors struct {
+	Errors []struct {
+		Error       string `json:"error"`
+		Description string `json:"description"`
+	} `json:"errors"`
+}
+
+// CheckJSONErrors returns the first error reported in the JSON output
+func CheckJSONErrors(input []byte) error {
+	var errs jsonErrors
+	json.Unmarshal(input, &errs)
+	for _, e := range errs.Errors {
+		msg := e.Error
+		if msg == "" {
+			msg = e.Description
+		}
+		if msg != "" {
+			return errors.New(msg)
+		}
+	}
+	return nil
+}
+
+// jsonNumber decodes plain numbers as well as the {"set", "infinite",
+// "number"} objects used by newer versions of Slurm. Unset and infinite
+// numbers are decoded as zero.
+type jsonNumber float64
+
+func (n *jsonNumber) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '{' {
+		var v struct {
+			Set      bool    `json:"set"`
+			Infinite bool    `json:"infinite"`
+			Number   float64 `json:"number"`
+		}
+		if err := json.Unmarshal(data, &v); err != nil {
+			return err
+		}
+		*n = 0
+		if v.Set && !v.Infinite {
+			*n = jsonNumber(v.Number)
+		}
+		return nil
+	}
+	var f *float64
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	*n = 0
+	if f != nil {
+		*n = jsonNumber(*f)
+	}
+	return nil
+}
+
+// jsonOptionalNumber is a number which may be unset, reported as null or
+// NO_VAL by older versions of Slurm and flagged as not set by newer ones
+type jsonOptionalNumber struct {
+	Set    bool
+	Number float64
+}
+
+func (n *jsonOptionalNumber) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '{' {
+		var v struct {
+			Set      bool    `json:"set"`
+			Infinite bool    `json:"infinite"`
+			Number   float64 `json:"number"`
+		}
+		if err := json.Unmarshal(data, &v); err != nil {
+			return err
+		}
+		*n = jsonOptionalNumber{Set: v.Set && !v.Infinite, Number: v.Number}
+		return nil
+	}
+	var f *float64
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	*n = jsonOptionalNumber{}
+	// NO_VAL and INFINITE of the 32 bit numbers of Slurm
+	if f != nil && *f < 0xfffffffe {
+		*n = jsonOptionalNumber{Set: true, Number: *f}
+	}
+	return nil
+}
+
+// jsonStrings decodes a single string as well as a list of strings, newer
+// versions of Slurm report states and features as lists
+type jsonStrings []string
+
+func (s *jsonStrings) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '[' {
+		var list []string
+		if err := json.Unmarshal(data, &list); err != nil {
+			return err
+		}
+		*s = list
+		return nil
+	}
+	var str *string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	*s = nil
+	if str != nil && *str != "" {
+		*s = jsonStrings{*str}
+	}
+	return nil
+}
+
+func (s jsonStrings) contains(value string) bool {
+	for _, v := range s {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+type jsonJob struct {
+	JobID       jsonNumber         `json:"job_id"`
+	ArrayJobID  jsonNumber         `json:"array_job_id"`
+	ArrayTaskID jsonOptionalNumber `json:"array_task_id"`
+	ArrayTasks  string             `json:"array_task_string"`
+	JobState    jsonStrings        `json:"job_state"`
+	CPUs        jsonNumber         `json:"cpus"`
+	Partition   string             `json:"partition"`
+	UserName    string             `json:"user_name"`
+	Account     string             `json:"account"`
+	QOS         string             `json:"qos"`
+	StateReason string             `json:"state_reason"`
+	Name        string             `json:"name"`
+	NodeCount   jsonNumber         `json:"node_count"`
+	// Memory in megabytes, either per node or per CPU
+	MemoryPerNode jsonNumber `json:"memory_per_node"`
+	MemoryPerCPU  jsonNumber `json:"memory_per_cpu"`
+	TresPerNode   string     `json:"tres_per_node"`
+	TresReqStr    string     `json:"tres_req_str"`
+	TresAllocStr  string     `json:"tres_alloc_str"`
+	// Time limit in minutes
+	TimeLimit  jsonNumber `json:"time_limit"`
+	SubmitTime jsonNumber `json:"submit_time"`
+	StartTime  jsonNumber `json:"start_time"`
+}
+
+// Convert a Unix timestamp, zero is returned as zero time
+func jsonTime(n jsonNumber) time.Time {
+	if n <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(n), 0)
+}
+
+// ParseJobsJSON converts the output of squeue --json or the jobs endpoint
+func ParseJobsJSON(input []byte) ([]Job, error) {
+	var resp struct {
+		Jobs []jsonJob `json:"jobs"`
+	}
+	if err := json.Unmarshal(input, &resp); err != nil {
+		return nil, err
+	}
+	jobs := make([]Job, 0, len(resp.Jobs))
+	for _, j := range resp.Jobs {
+		// Same job ids as squeue -r, <array job>_<task> for job array
+		// tasks, the tasks of an array not yet started share one record
+		ids := []string{fmt.Sprintf("%.0f", float64(j.JobID))}
+		if j.ArrayJobID > 0 {
+			switch {
+			case j.ArrayTaskID.Set:
+				ids = []string{fmt.Sprintf("%.0f_%.0f", float64(j.ArrayJobID), j.ArrayTaskID.Number)}
+			case j.ArrayTasks != "":
+				ids = nil
+				tasks, err := arrayTasks(j.ArrayTasks)
+				if err != nil {
+					return nil, err
+				}
+				for _, task := range tasks {
+					ids = append(ids, fmt.Sprintf("%.0f_%d", float64(j.ArrayJobID), task))
+				}
+			}
+		}
+		// The first state is the base state, e.g. PENDING of PENDING,REQUEUED
+		state := ""
+		if len(j.JobState) > 0 {
+			state = strings.ToUpper(j.JobState[0])
+		}
+		job := Job{
+			State:      state,
+			CPUs:       float64(j.CPUs),
+			Partition:  j.Partition,
+			User:       j.UserName,
+			Account:    j.Account,
+			QOS:        j.QOS,
+			Reason:     j.StateReason,
+			Name:       j.Name,
+			Nodes:      float64(j.NodeCount),
+			Memory:     float64(j.MemoryPerNode*j.NodeCount) * (1 << 20),
+			Gres:       jobGres(j.TresPerNode),
+			ReqTRES:    ParseTRES(j.TresReqStr),
+			AllocTRES:  ParseTRES(j.TresAllocStr),
+			TimeLimit:  float64(j.TimeLimit) * 60,
+			SubmitTime: jsonTime(j.SubmitTime),
+		}
+		job.GPUs = GresCount(job.Gres, "gpu") * job.Nodes
+		if j.MemoryPerCPU > 0 {
+			job.Memory = float64(j.MemoryPerCPU*j.CPUs) * (1 << 20)
+		}
+		// Pending jobs report their expected start time, the elapsed time
+		// is not part of the JSON output
+		if state != "PENDING" {
+			job.StartTime = jsonTime(j.StartTime)
+			if !job.StartTime.IsZero() {
+				job.Elapsed = time.Since(job.StartTime).Seconds()
+			}
+		}
+		for _, id := range ids {
+			job.ID = id
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, nil
+}
+
+// Task ids of a job array like "1,3,5-7" or "0-15:4%2", the step after the
+// colon and the limit of tasks running at once after the percent sign
+func arrayTasks(spec string) ([]int, error) {
+	if i := strings.Index(spec, "%"); i >= 0 {
+		spec = spec[:i]
+	}
+	var tasks []int
+	for _, part := range strings.Split(spec, ",") {
+		step := 1
+		if i := strings.Index(part, ":"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step in job array %q", spec)
+			}
+			part = part[:i]
+		}
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid job array %q", spec)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("invalid job array %q", spec)
+			}
+		}
+		for task := first; task <= last; task += step {
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks, nil
+}
+
+type jsonNode struct {
+	Name           string      `json:"name"`
+	Partitions     []string    `json:"partitions"`
+	State          jsonStrings `json:"state"`
+	StateFlags     jsonStrings `json:"state_flags"`
+	CPUs           jsonNumber  `json:"cpus"`
+	AllocCPUs      jsonNumber  `json:"alloc_cpus"`
+	AllocMemory    jsonNumber  `json:"alloc_memory"`
+	RealMemory     jsonNumber  `json:"real_memory"`
+	ActiveFeatures jsonStrings `json:"active_features"`
+	Gres           string      `json:"gres"`
+	GresUsed       string      `json:"gres_used"`
+}
+
+// Long node state in the same format as printed by sinfo, e.g. "drained"
+// or "down*", the JSON output has the base state and its flags separately
+func jsonNodeState(states jsonStrings) string {
+	base := "unknown"
+	if len(states) > 0 {
+		base = strings.ToLower(states[0])
+	}
+	var state string
+	switch {
+	case states.contains("DRAIN"):
+		if base == "allocated" || base == "mixed" || states.contains("COMPLETING") {
+			state = "draining"
+		} else {
+			state = "drained"
+		}
+	case states.contains("FAIL"):
+		if base == "allocated" || base == "mixed" {
+			state = "failing"
+		} else {
+			state = "fail"
+		}
+	case states.contains("MAINTENANCE"):
+		state = "maint"
+	case states.contains("RESERVED"):
+		state = "reserved"
+	case states.contains("PLANNED"):
+		state = "planned"
+	case states.contains("COMPLETING"):
+		state = "completing"
+	default:
+		state = base
+	}
+	if states.contains("NOT_RESPONDING") {
+		state += "*"
+	}
+	return state
+}
+
+// ParseNodesJSON converts the output of scontrol show nodes --json or the
+// nodes endpoint, every node is listed once for each of its partitions
+// like with sinfo -N
+func ParseNodesJSON(input []byte) ([]Node, error) {
+	var resp struct {
+		Nodes []jsonNode `json:"nodes"`
+	}
+	if err := json.Unmarshal(input, &resp); err != nil {
+		return nil, err
+	}
+	var nodes []Node
+	for _, n := range resp.Nodes {
+		states := append(append(jsonStrings{}, n.State...), n.StateFlags...)
+		node := Node{
+			Name:      n.Name,
+			State:     jsonNodeState(states),
+			CPUsAlloc: float64(n.AllocCPUs),
+			CPUsTotal: float64(n.CPUs),
+			MemAlloc:  float64(n.AllocMemory),
+			MemTotal:  float64(n.RealMemory),
+			Features:  strings.Join(n.ActiveFeatures, ","),
+			Gres:      n.Gres,
+			GresUsed:  n.GresUsed,
+		}
+		// Like sinfo, the CPUs not allocated on unavailable nodes are
+		// reported as other instead of idle
+		free := node.CPUsTotal - node.CPUsAlloc
+		if states.contains("DOWN") || states.contains("DRAIN") || states.contains("FAIL") {
+			node.CPUsOther = free
+		} else {
+			node.CPUsIdle = free
+		}
+		if node.Features == "" {
+			node.Features = "(null)"
+		}
+		for _, partition := range n.Partitions {
+			node.Partition = partition
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes, nil
+}
+
+type jsonRPCStats struct {
+	TypeID      jsonNumber `json:"type_id"`
+	MessageType string     `json:"message_type"`
+	UserID      jsonNumber `json:"user_id"`
+	User        string     `json:"user"`
+	Count       jsonNumber `json:"count"`
+	AverageTime jsonNumber `json:"average_time"`
+	TotalTime   jsonNumber `json:"total_time"`
+}
+
+// ParseDiagJSON converts the output of sdiag --json or the diag endpoint
+func ParseDiagJSON(input []byte) (*SchedulerMetrics, error) {
+	var resp struct {
+		Statistics struct {
+			ServerThreadCount      jsonNumber     `json:"server_thread_count"`
+			ReqTimeStart           jsonNumber     `json:"req_time_start"`
+			AgentQueueSize         jsonNumber     `json:"agent_queue_size"`
+			AgentCount             jsonNumber     `json:"agent_count"`
+			AgentThreadCount       jsonNumber     `json:"agent_thread_count"`
+			DbdAgentQueueSize      jsonNumber     `json:"dbd_agent_queue_size"`
+			JobsSubmitted          jsonNumber     `json:"jobs_submitted"`
+			JobsStarted            jsonNumber     `json:"jobs_started"`
+			JobsCompleted          jsonNumber     `json:"jobs_completed"`
+			JobsCanceled           jsonNumber     `json:"jobs_canceled"`
+			JobsFailed             jsonNumber     `json:"jobs_failed"`
+			JobsPending            jsonNumber     `json:"jobs_pending"`
+			JobsRunning            jsonNumber     `json:"jobs_running"`
+			ScheduleCycleLast      jsonNumber     `json:"schedule_cycle_last"`
+			ScheduleCycleMax       jsonNumber     `json:"schedule_cycle_max"`
+			ScheduleCycleTotal     jsonNumber     `json:"schedule_cycle_total"`
+			ScheduleCycleMean      jsonNumber     `json:"schedule_cycle_mean"`
+			ScheduleCycleMeanDepth jsonNumber     `json:"schedule_cycle_mean_depth"`
+			ScheduleCyclePerMinute jsonNumber     `json:"schedule_cycle_per_minute"`
+			ScheduleQueueLength    jsonNumber     `json:"schedule_queue_length"`
+			BfCycleCounter         jsonNumber     `json:"bf_cycle_counter"`
+			BfWhenLastCycle        jsonNumber     `json:"bf_when_last_cycle"`
+			BfCycleLast            jsonNumber     `json:"bf_cycle_last"`
+			BfCycleMax             jsonNumber     `json:"bf_cycle_max"`
+			BfCycleMean            jsonNumber     `json:"bf_cycle_mean"`
+			BfLastDepth            jsonNumber     `json:"bf_last_depth"`
+			BfLastDepthTry         jsonNumber     `json:"bf_last_depth_try"`
+			BfDepthMean            jsonNumber     `json:"bf_depth_mean"`
+			BfDepthMeanTry         jsonNumber     `json:"bf_depth_mean_try"`
+			BfQueueLen             jsonNumber     `json:"bf_queue_len"`
+			BfQueueLenMean         jsonNumber     `json:"bf_queue_len_mean"`
+			BfTableSize            jsonNumber     `json:"bf_table_size"`
+			BfTableSizeMean        jsonNumber     `json:"bf_table_size_mean"`
+			BfBackfilledJobs       jsonNumber     `json:"bf_backfilled_jobs"`
+			BfLastBackfilledJobs   jsonNumber     `json:"bf_last_backfilled_jobs"`
+			BfBackfilledHetJobs    jsonNumber     `json:"bf_backfilled_het_jobs"`
+			RPCsByMessageType      []jsonRPCStats `json:"rpcs_by_message_type"`
+			RPCsByUser             []jsonRPCStats `json:"rpcs_by_user"`
+			PendingRPCs            []jsonRPCStats `json:"pending_rpcs"`
+		} `json:"statistics"`
+	}
+	if err := json.Unmarshal(input, &resp); err != nil {
+		return nil, err
+	}
+	st := resp.Statistics
+	sm := &SchedulerMetrics{
+		threads:                           float64(st.ServerThreadCount),
+		queue_size:                        float64(st.AgentQueueSize),
+		agent_count:                       float64(st.AgentCount),
+		agent_thread_count:                float64(st.AgentThreadCount),
+		dbd_queue_size:                    float64(st.DbdAgentQueueSize),
+		jobs_submitted:                    float64(st.JobsSubmitted),
+		jobs_started:                      float64(st.JobsStarted),
+		jobs_completed:                    float64(st.JobsCompleted),
+		jobs_canceled:                     float64(st.JobsCanceled),
+		jobs_failed:                       float64(st.JobsFailed),
+		jobs_pending:                      float64(st.JobsPending),
+		jobs_running:                      float64(st.JobsRunning),
+		last_cycle:                        float64(st.ScheduleCycleLast),
+		max_cycle:                         float64(st.ScheduleCycleMax),
+		total_cycles:                      float64(st.ScheduleCycleTotal),
+		mean_cycle:                        float64(st.ScheduleCycleMean),
+		mean_depth_cycle:                  float64(st.ScheduleCycleMeanDepth),
+		cycle_per_minute:                  float64(st.ScheduleCyclePerMinute),
+		last_queue_length:                 float64(st.ScheduleQueueLength),
+		backfill_total_cycles:             float64(st.BfCycleCounter),
+		backfill_last_cycle_when:          float64(st.BfWhenLastCycle),
+		backfill_last_cycle:               float64(st.BfCycleLast),
+		backfill_max_cycle:                float64(st.BfCycleMax),
+		backfill_mean_cycle:               float64(st.BfCycleMean),
+		backfill_last_depth_cycle:         float64(st.BfLastDepth),
+		backfill_last_depth_cycle_try:     float64(st.BfLastDepthTry),
+		backfill_depth_mean:               float64(st.BfDepthMean),
+		backfill_depth_mean_try:           float64(st.BfDepthMeanTry),
+		backfill_last_queue_length:        float64(st.BfQueueLen),
+		backfill_queue_length_mean:        float64(st.BfQueueLenMean),
+		backfill_last_table_size:          float64(st.BfTableSize),
+		backfill_mean_table_size:          float64(st.BfTableSizeMean),
+		total_backfilled_jobs_since_start: float64(st.BfBackfilledJobs),
+		total_backfilled_jobs_since_cycle: float64(st.BfLastBackfilledJobs),
+		total_backfilled_heterogeneous:    float64(st.BfBackfilledHetJobs),
+		stats_since:                       float64(st.ReqTimeStart),
+		rpc_stats_count:                   make(map[string]float64),
+		rpc_stats_avg_time:                make(map[string]float64),
+		rpc_stats_total_time:              make(map[string]float64),
+		user_rpc_stats_count:              make(map[string]float64),
+		user_rpc_stats_avg_time:           make(map[string]float64),
+		user_rpc_stats_total_time:         make(map[string]float64),
+		rpc_pending:                       make(map[string]float64),
+		rpc_type_ids:                      make(map[string]string),
+		user_rpc_ids:                      make(map[string]string),
+	}
+	for _, rpc := range st.RPCsByMessageType {
+		sm.rpc_stats_count[rpc.MessageType] = float64(rpc.Count)
+		sm.rpc_stats_avg_time[rpc.MessageType] = float64(rpc.AverageTime)
+		sm.rpc_stats_total_time[rpc.MessageType] = float64(rpc.TotalTime)
+		sm.rpc_type_ids[rpc.MessageType] = strconv.Itoa(int(rpc.TypeID))
+	}
+	for _, rpc := range st.PendingRPCs {
+		sm.rpc_pending[rpc.MessageType] = float64(rpc.Count)
+		sm.rpc_type_ids[rpc.MessageType] = strconv.Itoa(int(rpc.TypeID))
+	}
+	for _, rpc := range st.RPCsByUser {
+		sm.user_rpc_stats_count[rpc.User] = float64(rpc.Count)
+		sm.user_rpc_stats_avg_time[rpc.User] = float64(rpc.AverageTime)
+		sm.user_rpc_stats_total_time[rpc.User] = float64(rpc.TotalTime)
+		sm.user_rpc_ids[rpc.User] = strconv.Itoa(int(rpc.UserID))
+	}
+	return sm, nil
+}
+
+// ParseSharesJSON converts the response of the shares endpoint, only the
+// accounts are kept like with sshare
+func ParseSharesJSON(input []byte) (map[string]*FairShareMetrics, error) {
+	var resp struct {
+		Shares struct {
+			Shares []struct {
+				Name      string      `json:"name"`
+				Type      jsonStrings `json:"type"`
+				FairShare struct {
+					Factor jsonNumber `json:"factor"`
+				} `json:"fairshare"`
+			} `json:"shares"`
+		} `json:"shares"`
+	}
+	if err := json.Unmarshal(input, &resp); err != nil {
+		return nil, err
+	}
+	accounts := make(map[string]*FairShareMetrics)
+	for _, share := range resp.Shares.Shares {
+		if share.Type.contains("USER") {
+			continue
+		}
+		accounts[share.Name] = &FairShareMetrics{float64(share.FairShare.Factor)}
+	}
+	return accounts, nil
+}
+
+// ParsePingJSON converts the output of scontrol --json ping or the ping
+// endpoint, the latency is reported in microseconds
+func ParsePingJSON(input []byte) ([]Controller, error) {
+	var resp struct {
+		Pings []struct {
+			Hostname   string     `json:"hostname"`
+			Mode       string     `json:"mode"`
+			Pinged     string     `json:"pinged"`
+			Responding *bool      `json:"responding"`
+			Latency    jsonNumber `json:"latency"`
+		} `json:"pings"`
+	}
+	if err := json.Unmarshal(input, &resp); err != nil {
+		return nil, err
+	}
+	controllers := make([]Controller, 0, len(resp.Pings))
+	for _, ping := range resp.Pings {
+		up := ping.Pinged == "UP"
+		// Newer versions report the state as a boolean in addition
+		if ping.Responding != nil {
+			up = *ping.Responding
+		}
+		controllers = append(controllers, Controller{
+			Host:    ping.Hostname,
+			Mode:    ping.Mode,
+			Up:      up,
+			Latency: float64(ping.Latency) / 1e6,
+		})
+	}
+	return controllers, nil
+}
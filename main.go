@@ -17,23 +17,49 @@ package main
 
 import (
 	"flag"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"fmt"
 	"github.com/prometheus/common/log"
 	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 )
 
-func init() {
-	// Metrics have to be registered to be exposed
-	prometheus.MustRegister(NewAccountsCollector())       // from accounts.go
-	prometheus.MustRegister(NewCPUsCollector())           // from cpus.go
-	prometheus.MustRegister(NewNodesCollector())          // from nodes.go
-	prometheus.MustRegister(NewNodeCollector())           // from node.go
-	prometheus.MustRegister(NewPartitionsCollector())     // from partitions.go
-	prometheus.MustRegister(NewQueueCollector())          // from queue.go
-	prometheus.MustRegister(NewSchedulerCollector())      // from scheduler.go
-	prometheus.MustRegister(NewFairShareCollector())      // from sshare.go
-	prometheus.MustRegister(NewUsersCollector())          // from users.go
+// keyValueFlags collects repeated "<name>=<value>" command line options.
+type keyValueFlags map[string]string
+
+func (f keyValueFlags) String() string {
+	values := make([]string, 0, len(f))
+	for command, value := range f {
+		values = append(values, command+"="+value)
+	}
+	sort.Strings(values)
+	return strings.Join(values, ",")
+}
+
+func (f keyValueFlags) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("expected <name>=<value>, got %q", value)
+	}
+	f[kv[0]] = kv[1]
+	return nil
+}
+
+// Durations returns the values parsed as durations.
+func (f keyValueFlags) Durations() (map[string]time.Duration, error) {
+	durations := make(map[string]time.Duration)
+	for name, value := range f {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration for %s: %v", name, err)
+		}
+		durations[name] = d
+	}
+	return durations, nil
 }
 
 var listenAddress = flag.String(
@@ -41,23 +67,210 @@ var listenAddress = flag.String(
 	":8080",
 	"The address to listen on for HTTP requests.")
 
+var configFile = flag.String(
+	"config.file",
+	"",
+	"YAML configuration file overriding the command line options, reloaded on SIGHUP or a POST to /-/reload.")
+
+var webConfigFile = flag.String(
+	"web.config.file",
+	"",
+	"Path to the web configuration file enabling TLS and basic authentication, reloaded with the configuration file.")
+
+var gpusAllocation = flag.String(
+	"collector.gpus.allocation",
+	GPUsAllocGres,
+	"Source of the allocated GPUs: gres for the generic resources in use on the nodes reported by sinfo, sacct for the running jobs in the accounting database.")
+
 var gpuAcct = flag.Bool(
 	"gpus-acct",
 	false,
-	"Enable GPUs accounting")
+	"Enable GPUs accounting, same as -collector.gpus")
+
+var slurmBinDir = flag.String(
+	"slurm.bin-dir",
+	"/usr/bin",
+	"Directory containing the Slurm command line tools.")
+
+var slurmTimeout = flag.Duration(
+	"slurm.timeout",
+	30*time.Second,
+	"Timeout for the execution of a Slurm command, 0 disables the timeout.")
+
+var slurmClusters = flag.String(
+	"slurm.clusters",
+	"",
+	"Comma separated list of clusters to scrape with the -M option of the Slurm commands, adding a cluster label to all metrics. Empty scrapes the local cluster only.")
+
+var slurmOutputFormat = flag.String(
+	"slurm.output-format",
+	FormatAuto,
+	"Output format of the Slurm commands: json, text or auto to use the JSON output if supported by the installed Slurm version.")
+
+var slurmRestURL = flag.String(
+	"slurm.rest-url",
+	"",
+	"Base URL of slurmrestd, e.g. http://slurmrestd:6820. If set the data is read from the Slurm REST API instead of the Slurm commands.")
+
+var slurmRestVersion = flag.String(
+	"slurm.rest-api-version",
+	"v0.0.40",
+	"Version of the Slurm REST API.")
+
+var slurmRestUser = flag.String(
+	"slurm.rest-user",
+	"",
+	"User name sent to slurmrestd along with the token.")
+
+var slurmRestTokenFile = flag.String(
+	"slurm.rest-token-file",
+	"",
+	"File holding the JWT for slurmrestd, re-read on every request. Defaults to the SLURM_JWT environment variable.")
+
+var pollInterval = flag.Duration(
+	"poll.interval",
+	0,
+	"Query Slurm in the background on this interval and serve the cached metrics, 0 queries Slurm on every scrape.")
+
+var queueLabels = flag.String(
+	"collector.queue.labels",
+	strings.Join(DefaultQueueLabels, ","),
+	"Comma separated job attributes exposed as labels of the queue metrics: user, partition, account, qos, array or gres. Pending jobs are labeled with their reason in addition.")
+
+var jobsLimit = flag.Int(
+	"collector.jobs.limit",
+	0,
+	"Number of jobs exposed by the jobs collector, those requesting the most GPUs, CPUs and memory. 0 exposes all jobs.")
+
+var rpcUserLimit = flag.Int(
+	"collector.scheduler.rpc-user-limit",
+	0,
+	"Number of users exposed with their RPC statistics by the scheduler collector, those with the most RPCs. 0 exposes all users.")
+
+var slurmPaths = make(keyValueFlags)
+var aggregations = make(keyValueFlags)
+var slurmTimeouts = make(keyValueFlags)
+var pollIntervals = make(keyValueFlags)
+
+// State of the -collector.<name> and -no-collector.<name> options
+var collectorFlags = make(map[string]*bool)
+var noCollectorFlags = make(map[string]*bool)
+
+func init() {
+	for name, entry := range collectorEntries {
+		collectorFlags[name] = flag.Bool("collector."+name, entry.enabled,
+			fmt.Sprintf("Enable the %s collector.", name))
+		noCollectorFlags[name] = flag.Bool("no-collector."+name, false,
+			fmt.Sprintf("Disable the %s collector.", name))
+	}
+	flag.Var(aggregations, "collector.aggregation",
+		"Aggregation of the jobs exposed as slurm_aggregate_<name>_jobs and slurm_aggregate_<name>_cores, as <name>=<labels> with comma separated labels among user, account, partition, qos, reason, state, array and gres (repeatable).")
+	flag.Var(slurmPaths, "slurm.path",
+		"Path of a single Slurm command as <command>=<path>, e.g. sdiag=/opt/slurm/bin/sdiag (repeatable).")
+	flag.Var(slurmTimeouts, "slurm.command-timeout",
+		"Timeout of a single Slurm command as <command>=<duration>, e.g. sacct=2m (repeatable).")
+	flag.Var(pollIntervals, "poll.collector-interval",
+		"Background refresh interval of a single collector as <collector>=<duration>, e.g. node=2m (repeatable).")
+}
+
+// Split a comma separated list, ignoring empty entries
+func splitList(s string) []string {
+	var list []string
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// Build the configuration from the command line options
+func configFromFlags() (*Config, error) {
+	config := &Config{
+		Collectors: make(map[string]bool),
+		Slurm: SlurmConfig{
+			BinDir:       *slurmBinDir,
+			Paths:        make(map[string]string),
+			Timeout:      *slurmTimeout,
+			OutputFormat: *slurmOutputFormat,
+			Rest: RestConfig{
+				URL:        *slurmRestURL,
+				APIVersion: *slurmRestVersion,
+				User:       *slurmRestUser,
+				TokenFile:  *slurmRestTokenFile,
+			},
+		},
+		Poll: PollConfig{
+			Interval: *pollInterval,
+		},
+		Jobs: JobsConfig{
+			Limit: *jobsLimit,
+		},
+		GPUs: GPUsConfig{
+			Allocation: *gpusAllocation,
+		},
+		Scheduler: SchedulerConfig{
+			RPCUserLimit: *rpcUserLimit,
+		},
+	}
+	for name := range collectorEntries {
+		enabled := *collectorFlags[name] && !*noCollectorFlags[name]
+		// Turn on GPUs accounting also with the former command line option
+		if name == "gpus" && *gpuAcct && !*noCollectorFlags[name] {
+			enabled = true
+		}
+		config.Collectors[name] = enabled
+	}
+	for command, path := range slurmPaths {
+		config.Slurm.Paths[command] = path
+	}
+	var err error
+	if config.Slurm.CommandTimeouts, err = slurmTimeouts.Durations(); err != nil {
+		return nil, err
+	}
+	if config.Poll.CollectorIntervals, err = pollIntervals.Durations(); err != nil {
+		return nil, err
+	}
+	config.Queue.Labels = splitList(*queueLabels)
+	config.Aggregations = make(map[string][]string)
+	for name, labels := range aggregations {
+		config.Aggregations[name] = splitList(labels)
+	}
+	config.Slurm.Clusters = splitList(*slurmClusters)
+	return config, nil
+}
 
 func main() {
 	flag.Parse()
 
-	// Turn on GPUs accounting only if the corresponding command line option is set to true.
-	if *gpuAcct {
-		prometheus.MustRegister(NewGPUsCollector())   // from gpus.go
+	defaults, err := configFromFlags()
+	if err != nil {
+		log.Fatal(err)
+	}
+	server, err := NewServer(defaults, *configFile)
+	if err != nil {
+		log.Fatal(err)
 	}
+	server.Web, err = NewWebServer(*webConfigFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Reload the configuration files on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := server.Reload(); err != nil {
+				log.Errorf("Reloading the configuration failed: %v", err)
+			}
+		}
+	}()
 
 	// The Handler function provides a default handler to expose metrics
 	// via an HTTP server. "/metrics" is the usual endpoint for that.
 	log.Infof("Starting Server: %s", *listenAddress)
-	log.Infof("GPUs Accounting: %t", *gpuAcct)
-	http.Handle("/metrics", promhttp.Handler())
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+	http.Handle("/metrics", server)
+	http.Handle("/-/reload", server.ReloadHandler())
+	log.Fatal(server.Web.ListenAndServe(&http.Server{Addr: *listenAddress}))
 }
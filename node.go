@@ -16,83 +16,39 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>. */
 package main
 
 import (
-	"log"
-	"os"
-	"os/exec"
-	"sort"
-	"strconv"
-	"strings"
-
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 // NodeMetrics stores metrics for each node
 type NodeMetrics struct {
-	memAlloc uint64
-	memTotal uint64
-	cpuAlloc uint64
-	cpuIdle  uint64
-	cpuOther uint64
-	cpuTotal uint64
+	memAlloc   uint64
+	memTotal   uint64
+	cpuAlloc   uint64
+	cpuIdle    uint64
+	cpuOther   uint64
+	cpuTotal   uint64
 	nodeStatus string
 }
 
-func NodeGetMetrics() map[string]*NodeMetrics {
-	return ParseNodeMetrics(NodeData())
-}
-
-// ParseNodeMetrics takes the output of sinfo with node data
-// It returns a map of metrics per node
-func ParseNodeMetrics(input []byte) map[string]*NodeMetrics {
+// ParseNodeMetrics returns the CPUs and memory of every node
+func ParseNodeMetrics(list []Node) map[string]*NodeMetrics {
 	nodes := make(map[string]*NodeMetrics)
-	lines := strings.Split(string(input), "\n")
-
-	// Sort and remove all the duplicates from the 'sinfo' output
-	sort.Strings(lines)
-	linesUniq := RemoveDuplicates(lines)
-
-	for _, line := range linesUniq {
-		node := strings.Fields(line)
-		nodeName := node[0]
-		nodeStatus := node[4] // mixed, allocated, etc.
-
-		nodes[nodeName] = &NodeMetrics{0, 0, 0, 0, 0, 0, ""}
-
-		memAlloc, _ := strconv.ParseUint(node[1], 10, 64)
-		memTotal, _ := strconv.ParseUint(node[2], 10, 64)
-
-
-		cpuInfo := strings.Split(node[3], "/")
-		cpuAlloc, _ := strconv.ParseUint(cpuInfo[0], 10, 64)
-		cpuIdle, _ := strconv.ParseUint(cpuInfo[1], 10, 64)
-		cpuOther, _ := strconv.ParseUint(cpuInfo[2], 10, 64)
-		cpuTotal, _ := strconv.ParseUint(cpuInfo[3], 10, 64)
-
-		nodes[nodeName].memAlloc = memAlloc
-		nodes[nodeName].memTotal = memTotal
-		nodes[nodeName].cpuAlloc = cpuAlloc
-		nodes[nodeName].cpuIdle = cpuIdle
-		nodes[nodeName].cpuOther = cpuOther
-		nodes[nodeName].cpuTotal = cpuTotal
-		nodes[nodeName].nodeStatus = nodeStatus
+	for _, node := range UniqueNodes(list) {
+		nodes[node.Name] = &NodeMetrics{
+			memAlloc:   uint64(node.MemAlloc),
+			memTotal:   uint64(node.MemTotal),
+			cpuAlloc:   uint64(node.CPUsAlloc),
+			cpuIdle:    uint64(node.CPUsIdle),
+			cpuOther:   uint64(node.CPUsOther),
+			cpuTotal:   uint64(node.CPUsTotal),
+			nodeStatus: node.State,
+		}
 	}
-
 	return nodes
 }
 
-// NodeData executes the sinfo command to get data for each node
-// It returns the output of the sinfo command
-func NodeData() []byte {
-	cmd := exec.Command("/usr/bin/sinfo", "-h", "-N", "-O", "NodeList,AllocMem,Memory,CPUsState,StateLong")
-	cmd.Env = append(os.Environ(), "PATH=/usr/bin:/bin:/usr/sbin:/sbin")
-	out, err := cmd.Output()
-	if err != nil {
-		log.Fatal(err)
-	}
-	return out
-}
-
 type NodeCollector struct {
+	slurm    *Slurm
 	cpuAlloc *prometheus.Desc
 	cpuIdle  *prometheus.Desc
 	cpuOther *prometheus.Desc
@@ -103,10 +59,11 @@ type NodeCollector struct {
 
 // NewNodeCollector creates a Prometheus collector to keep all our stats in
 // It returns a set of collections for consumption
-func NewNodeCollector() *NodeCollector {
-	labels := []string{"node","status"}
+func NewNodeCollector(slurm *Slurm) *NodeCollector {
+	labels := []string{"node", "status"}
 
 	return &NodeCollector{
+		slurm:    slurm,
 		cpuAlloc: prometheus.NewDesc("slurm_node_cpu_alloc", "Allocated CPUs per node", labels, nil),
 		cpuIdle:  prometheus.NewDesc("slurm_node_cpu_idle", "Idle CPUs per node", labels, nil),
 		cpuOther: prometheus.NewDesc("slurm_node_cpu_other", "Other CPUs per node", labels, nil),
@@ -126,14 +83,19 @@ func (nc *NodeCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- nc.memTotal
 }
 
-func (nc *NodeCollector) Collect(ch chan<- prometheus.Metric) {
-	nodes := NodeGetMetrics()
+func (nc *NodeCollector) Update(ch chan<- prometheus.Metric) error {
+	list, err := nc.slurm.Nodes()
+	if err != nil {
+		return err
+	}
+	nodes := ParseNodeMetrics(list)
 	for node := range nodes {
 		ch <- prometheus.MustNewConstMetric(nc.cpuAlloc, prometheus.GaugeValue, float64(nodes[node].cpuAlloc), node, nodes[node].nodeStatus)
-		ch <- prometheus.MustNewConstMetric(nc.cpuIdle,  prometheus.GaugeValue, float64(nodes[node].cpuIdle),  node, nodes[node].nodeStatus)
+		ch <- prometheus.MustNewConstMetric(nc.cpuIdle, prometheus.GaugeValue, float64(nodes[node].cpuIdle), node, nodes[node].nodeStatus)
 		ch <- prometheus.MustNewConstMetric(nc.cpuOther, prometheus.GaugeValue, float64(nodes[node].cpuOther), node, nodes[node].nodeStatus)
 		ch <- prometheus.MustNewConstMetric(nc.cpuTotal, prometheus.GaugeValue, float64(nodes[node].cpuTotal), node, nodes[node].nodeStatus)
 		ch <- prometheus.MustNewConstMetric(nc.memAlloc, prometheus.GaugeValue, float64(nodes[node].memAlloc), node, nodes[node].nodeStatus)
 		ch <- prometheus.MustNewConstMetric(nc.memTotal, prometheus.GaugeValue, float64(nodes[node].memTotal), node, nodes[node].nodeStatus)
 	}
+	return nil
 }
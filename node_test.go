@@ -25,28 +25,29 @@ import (
 /*
 For this example data line:
 
-a048,79384,193000,3/13/0/16,mix
+a048|normal|mixed|8/8/0/16|79384|193000|...
 
 We want output that looks like:
 
-slurm_node_cpus_allocated{name="a048",status="mix"} 3
-slurm_node_cpus_idle{name="a048",status="mix"} 3
-slurm_node_cpus_other{name="a048",status="mix"} 0
-slurm_node_cpus_total{name="a048",status="mix"} 16
-slurm_node_mem_allocated{name="a048",status="mix"} 179384
-slurm_node_mem_total{name="a048",status="mix"} 193000
+slurm_node_cpu_alloc{node="a048",status="mixed"} 8
+slurm_node_cpu_idle{node="a048",status="mixed"} 8
+slurm_node_cpu_other{node="a048",status="mixed"} 0
+slurm_node_cpu_total{node="a048",status="mixed"} 16
+slurm_node_mem_alloc{node="a048",status="mixed"} 79384
+slurm_node_mem_total{node="a048",status="mixed"} 193000
 
 */
 
 func TestNodeMetrics(t *testing.T) {
 	// Read the input data from a file
-	data, err := ioutil.ReadFile("test_data/sinfo_mem.txt")
+	data, err := ioutil.ReadFile("test_data/sinfo_nodes.txt")
 	if err != nil {
 		t.Fatalf("Can not open test data: %v", err)
 	}
-	metrics := ParseNodeMetrics(data)
+	metrics := ParseNodeMetrics(ParseNodeList(data))
 	t.Logf("%+v", metrics)
 
+	assert.Equal(t, 11, len(metrics))
 	assert.Contains(t, metrics, "b001")
 	assert.Equal(t, uint64(327680), metrics["b001"].memAlloc)
 	assert.Equal(t, uint64(386000), metrics["b001"].memTotal)
@@ -54,4 +55,5 @@ func TestNodeMetrics(t *testing.T) {
 	assert.Equal(t, uint64(0), metrics["b001"].cpuIdle)
 	assert.Equal(t, uint64(0), metrics["b001"].cpuOther)
 	assert.Equal(t, uint64(32), metrics["b001"].cpuTotal)
+	assert.Equal(t, "mixed", metrics["a048"].nodeStatus)
 }
@@ -0,0 +1,120 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+/*
+ * A single node oriented sinfo call lists every node once per partition
+ * with all attributes needed by the cpus, gpus, node, nodes and partitions
+ * collectors. The output is parsed once into a list shared by those
+ * collectors.
+ */
+
+// Node holds the attributes of a node in one of its partitions
+type Node struct {
+	Name      string
+	Partition string
+	State     string
+	CPUsAlloc float64
+	CPUsIdle  float64
+	CPUsOther float64
+	CPUsTotal float64
+	MemAlloc  float64
+	MemTotal  float64
+	Features  string
+	Gres      string
+	GresUsed  string
+}
+
+// Fields of the sinfo output, each padded to the given width and
+// terminated by "|" so values containing spaces are kept intact
+var sinfoFormat = strings.Join([]string{
+	"NodeList:64|",
+	"PartitionName:64|",
+	"StateLong:32|",
+	"CPUsState:32|",
+	"AllocMem:20|",
+	"Memory:20|",
+	"FeaturesAct:256|",
+	"Gres:256|",
+	"GresUsed:256|",
+}, ",")
+
+const sinfoFields = 9
+
+// Execute the sinfo command and return its output
+func NodeListData(runner Runner) ([]byte, error) {
+	return runner.Run("sinfo", "-h", "-N", "-O", sinfoFormat)
+}
+
+// ParseNodeList extracts the list of nodes from the sinfo output
+func ParseNodeList(input []byte) []Node {
+	var nodes []Node
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) < sinfoFields {
+			continue
+		}
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		node := Node{
+			Name:      fields[0],
+			Partition: fields[1],
+			State:     fields[2],
+			Features:  fields[6],
+			Gres:      fields[7],
+			GresUsed:  fields[8],
+		}
+		cpus := strings.Split(fields[3], "/")
+		if len(cpus) == 4 {
+			node.CPUsAlloc, _ = strconv.ParseFloat(cpus[0], 64)
+			node.CPUsIdle, _ = strconv.ParseFloat(cpus[1], 64)
+			node.CPUsOther, _ = strconv.ParseFloat(cpus[2], 64)
+			node.CPUsTotal, _ = strconv.ParseFloat(cpus[3], 64)
+		}
+		node.MemAlloc, _ = strconv.ParseFloat(fields[4], 64)
+		node.MemTotal, _ = strconv.ParseFloat(fields[5], 64)
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+func NodeListGetMetrics(runner Runner) ([]Node, error) {
+	data, err := NodeListData(runner)
+	if err != nil {
+		return nil, err
+	}
+	return ParseNodeList(data), nil
+}
+
+// UniqueNodes returns every node only once, nodes are listed once for
+// each of their partitions
+func UniqueNodes(nodes []Node) []Node {
+	seen := make(map[string]bool)
+	var unique []Node
+	for _, node := range nodes {
+		if !seen[node.Name] {
+			seen[node.Name] = true
+			unique = append(unique, node)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,79 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNodeList(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sinfo_nodes.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	nodes := ParseNodeList(data)
+	assert.Equal(t, 13, len(nodes))
+	assert.Equal(t, 11, len(UniqueNodes(nodes)))
+	assert.Equal(t, Node{
+		Name:      "g003",
+		Partition: "gpu",
+		State:     "idle",
+		CPUsIdle:  32,
+		CPUsTotal: 32,
+		MemTotal:  256000,
+		Features:  "gpu,v100",
+		Gres:      "gpu:v100:2(S:0),mps:200",
+		GresUsed:  "gpu:v100:0(IDX:N/A),mps:0",
+	}, nodes[12])
+}
+
+func TestNodeListSharedBetweenCollectors(t *testing.T) {
+	runner := NewFakeRunner().File(t, "sinfo", "test_data/sinfo_nodes.txt").File(t, "squeue", "test_data/squeue.txt")
+	collectors, err := NewCollectors(NewCommandSource(runner), []string{"cpus", "node", "nodes", "partitions"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := NewSlurmExporter(collectors)
+	expected := `
+# HELP slurm_cpus_total Total CPUs
+# TYPE slurm_cpus_total gauge
+slurm_cpus_total 288
+# HELP slurm_nodes_total Total number of nodes
+# TYPE slurm_nodes_total gauge
+slurm_nodes_total 11
+# HELP slurm_partition_cpus_total Total CPUs for partition
+# TYPE slurm_partition_cpus_total gauge
+slurm_partition_cpus_total{partition="gpu"} 128
+slurm_partition_cpus_total{partition="long"} 96
+slurm_partition_cpus_total{partition="normal"} 96
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected),
+		"slurm_cpus_total", "slurm_nodes_total", "slurm_partition_cpus_total"); err != nil {
+		t.Error(err)
+	}
+	sinfo := 0
+	for _, call := range runner.Calls {
+		if strings.HasPrefix(call, "sinfo") {
+			sinfo++
+		}
+	}
+	assert.Equal(t, 1, sinfo)
+}
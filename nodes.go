@@ -16,16 +16,11 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>. */
 package main
 
 import (
-	"io/ioutil"
-	"os"
-	"os/exec"
 	"regexp"
 	"sort"
-	"strconv"
 	"strings"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
 )
 
 type NodesMetrics struct {
@@ -44,27 +39,6 @@ type NodesMetrics struct {
 	total   map[string]float64
 }
 
-func NodesGetMetrics(part string) *NodesMetrics {
-	return ParseNodesMetrics(NodesData(part))
-}
-
-func RemoveDuplicates(s []string) []string {
-	m := map[string]bool{}
-	t := []string{}
-
-	// Walk through the slice 's' and for each value we haven't seen so far, append it to 't'.
-	for _, v := range s {
-		if _, seen := m[v]; !seen {
-			if len(v) > 0 {
-				t = append(t, v)
-				m[v] = true
-			}
-		}
-	}
-
-	return t
-}
-
 func InitFeatureSet(nm *NodesMetrics, feature_set string) {
 	//lint:file-ignore SA4018 If the feature set exists keep, else assign nil
 	nm.alloc[feature_set] = nm.alloc[feature_set]
@@ -82,15 +56,8 @@ func InitFeatureSet(nm *NodesMetrics, feature_set string) {
 	nm.total[feature_set] = nm.total[feature_set]
 }
 
-func ParseNodesMetrics(input []byte) *NodesMetrics {
+func newNodesMetrics() *NodesMetrics {
 	var nm NodesMetrics
-	var feature_set string
-	lines := strings.Split(string(input), "\n")
-
-	// Sort and remove all the duplicates from the 'sinfo' output
-	sort.Strings(lines)
-	lines_uniq := RemoveDuplicates(lines)
-
 	nm.alloc = make(map[string]float64)
 	nm.comp = make(map[string]float64)
 	nm.down = make(map[string]float64)
@@ -104,132 +71,73 @@ func ParseNodesMetrics(input []byte) *NodesMetrics {
 	nm.other = make(map[string]float64)
 	nm.planned = make(map[string]float64)
 	nm.total = make(map[string]float64)
-
-	for _, line := range lines_uniq {
-		if strings.Contains(line, "|") {
-			split := strings.Split(line, "|")
-			state := split[1]
-			count, _ := strconv.ParseFloat(strings.TrimSpace(split[0]), 64)
-			features := strings.Split(split[2], ",")
-			sort.Strings(features)
-			feature_set = strings.Join(features[:], ",")
-			if feature_set == "(null)" {
-				feature_set = "null"
-			}
-			InitFeatureSet(&nm, feature_set)
-			alloc := regexp.MustCompile(`^alloc`)
-			comp := regexp.MustCompile(`^comp`)
-			down := regexp.MustCompile(`^down`)
-			drain := regexp.MustCompile(`^drain`)
-			fail := regexp.MustCompile(`^fail`)
-			err := regexp.MustCompile(`^err`)
-			idle := regexp.MustCompile(`^idle`)
-			maint := regexp.MustCompile(`^maint`)
-			mix := regexp.MustCompile(`^mix`)
-			resv := regexp.MustCompile(`^res`)
-			planned := regexp.MustCompile(`^planned`)
-			switch {
-			case alloc.MatchString(state):
-				nm.alloc[feature_set] += count
-			case comp.MatchString(state):
-				nm.comp[feature_set] += count
-			case down.MatchString(state):
-				nm.down[feature_set] += count
-			case drain.MatchString(state):
-				nm.drain[feature_set] += count
-			case fail.MatchString(state):
-				nm.fail[feature_set] += count
-			case err.MatchString(state):
-				nm.err[feature_set] += count
-			case idle.MatchString(state):
-				nm.idle[feature_set] += count
-			case maint.MatchString(state):
-				nm.maint[feature_set] += count
-			case mix.MatchString(state):
-				nm.mix[feature_set] += count
-			case resv.MatchString(state):
-				nm.resv[feature_set] += count
-			case planned.MatchString(state):
-				nm.planned[feature_set] += count
-			default:
-				nm.other[feature_set] += count
-			}
-		}
-	}
 	return &nm
 }
 
-// Execute the sinfo command and return its output
-func NodesData(part string) []byte {
-	cmd := exec.Command("/usr/bin/sinfo", "-h", "-o \"%D|%T|%b\"", "-p", part, "| sort", "| uniq")
-	cmd.Env = append(os.Environ(), "PATH=/usr/bin:/bin:/usr/sbin:/sbin")
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
-	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
-	}
-	out, _ := ioutil.ReadAll(stdout)
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
-	}
-	return out
-}
-
-func SlurmGetTotal() float64 {
-	cmd := exec.Command("/usr/bin/scontrol", "show", "nodes", "-o", "| grep", "-c", "'NodeName=[a-z]*[0-9]*'", "|| true")
-	cmd.Env = append(os.Environ(), "PATH=/usr/bin:/bin:/usr/sbin:/sbin")
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
-	}
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		log.Fatal(err)
-	}
-	if err := cmd.Start(); err != nil {
-		log.Fatalf("cmd.Start: %v", err)
-	}
-	out, _ := ioutil.ReadAll(stdout)
-	err_out, _ := ioutil.ReadAll(stderr)
-	if err := cmd.Wait(); err != nil {
-		log.Fatalf("cmd.Wait: %v %s %s", err, out, err_out)
-	}
-	data := strings.Split(string(out), "\n")
-	total, _ := strconv.ParseFloat(data[0], 64)
-	return total
-}
-
-func SlurmGetPartitions() []string {
-	cmd := exec.Command("/usr/bin/sinfo", "-h", "-o %R", "| sort", "| uniq")
-	cmd.Env = append(os.Environ(), "PATH=/usr/bin:/bin:/usr/sbin:/sbin")
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
-	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
-	}
-	out, _ := ioutil.ReadAll(stdout)
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
+// ParseNodesMetrics counts the nodes per partition, state and active feature set
+func ParseNodesMetrics(nodes []Node) map[string]*NodesMetrics {
+	partitions := make(map[string]*NodesMetrics)
+	alloc := regexp.MustCompile(`^alloc`)
+	comp := regexp.MustCompile(`^comp`)
+	down := regexp.MustCompile(`^down`)
+	drain := regexp.MustCompile(`^drain`)
+	fail := regexp.MustCompile(`^fail`)
+	err := regexp.MustCompile(`^err`)
+	idle := regexp.MustCompile(`^idle`)
+	maint := regexp.MustCompile(`^maint`)
+	mix := regexp.MustCompile(`^mix`)
+	resv := regexp.MustCompile(`^res`)
+	planned := regexp.MustCompile(`^planned`)
+	for _, node := range nodes {
+		nm, ok := partitions[node.Partition]
+		if !ok {
+			nm = newNodesMetrics()
+			partitions[node.Partition] = nm
+		}
+		features := strings.Split(node.Features, ",")
+		sort.Strings(features)
+		feature_set := strings.Join(features[:], ",")
+		if feature_set == "(null)" || feature_set == "" {
+			feature_set = "null"
+		}
+		InitFeatureSet(nm, feature_set)
+		state := node.State
+		switch {
+		case alloc.MatchString(state):
+			nm.alloc[feature_set]++
+		case comp.MatchString(state):
+			nm.comp[feature_set]++
+		case down.MatchString(state):
+			nm.down[feature_set]++
+		case drain.MatchString(state):
+			nm.drain[feature_set]++
+		case fail.MatchString(state):
+			nm.fail[feature_set]++
+		case err.MatchString(state):
+			nm.err[feature_set]++
+		case idle.MatchString(state):
+			nm.idle[feature_set]++
+		case maint.MatchString(state):
+			nm.maint[feature_set]++
+		case mix.MatchString(state):
+			nm.mix[feature_set]++
+		case resv.MatchString(state):
+			nm.resv[feature_set]++
+		case planned.MatchString(state):
+			nm.planned[feature_set]++
+		default:
+			nm.other[feature_set]++
+		}
 	}
-	partitions := strings.Split(string(out), "\n")
 	return partitions
 }
 
-/*
- * Implement the Prometheus Collector interface and feed the
- * Slurm scheduler metrics into it.
- * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
- */
-
-func NewNodesCollector() *NodesCollector {
+func NewNodesCollector(slurm *Slurm) *NodesCollector {
 	labelnames := make([]string, 0, 1)
 	labelnames = append(labelnames, "partition")
 	labelnames = append(labelnames, "active_feature_set")
 	return &NodesCollector{
+		slurm:   slurm,
 		alloc:   prometheus.NewDesc("slurm_nodes_alloc", "Allocated nodes", labelnames, nil),
 		comp:    prometheus.NewDesc("slurm_nodes_comp", "Completing nodes", labelnames, nil),
 		down:    prometheus.NewDesc("slurm_nodes_down", "Down nodes", labelnames, nil),
@@ -247,6 +155,7 @@ func NewNodesCollector() *NodesCollector {
 }
 
 type NodesCollector struct {
+	slurm   *Slurm
 	alloc   *prometheus.Desc
 	comp    *prometheus.Desc
 	down    *prometheus.Desc
@@ -285,14 +194,14 @@ func SendFeatureSetMetric(ch chan<- prometheus.Metric, desc *prometheus.Desc, va
 	}
 }
 
-func (nc *NodesCollector) Collect(ch chan<- prometheus.Metric) {
-	partitions := SlurmGetPartitions()
-	for _, part := range partitions {
-		part = strings.TrimSpace(part)
-		if part == "" {
-			continue
-		}
-		nm := NodesGetMetrics(part)
+func (nc *NodesCollector) Update(ch chan<- prometheus.Metric) error {
+	nodes, err := nc.slurm.Nodes()
+	if err != nil {
+		return err
+	}
+	metrics := ParseNodesMetrics(nodes)
+	total := float64(len(UniqueNodes(nodes)))
+	for part, nm := range metrics {
 		SendFeatureSetMetric(ch, nc.alloc, prometheus.GaugeValue, nm.alloc, part)
 		SendFeatureSetMetric(ch, nc.comp, prometheus.GaugeValue, nm.comp, part)
 		SendFeatureSetMetric(ch, nc.down, prometheus.GaugeValue, nm.down, part)
@@ -306,6 +215,6 @@ func (nc *NodesCollector) Collect(ch chan<- prometheus.Metric) {
 		SendFeatureSetMetric(ch, nc.other, prometheus.GaugeValue, nm.other, part)
 		SendFeatureSetMetric(ch, nc.planned, prometheus.GaugeValue, nm.planned, part)
 	}
-	total := SlurmGetTotal()
 	ch <- prometheus.MustNewConstMetric(nc.total, prometheus.GaugeValue, total)
+	return nil
 }
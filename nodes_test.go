@@ -17,7 +17,6 @@ package main
 
 import (
 	"io/ioutil"
-	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -25,19 +24,21 @@ import (
 
 func TestNodesMetrics(t *testing.T) {
 	// Read the input data from a file
-	file, err := os.Open("test_data/sinfo.txt")
+	data, err := ioutil.ReadFile("test_data/sinfo_nodes.txt")
 	if err != nil {
 		t.Fatalf("Can not open test data: %v", err)
 	}
-	data, err := ioutil.ReadAll(file)
-	nm := ParseNodesMetrics(data)
-	assert.Equal(t, 10, int(nm.idle["feature_a,feature_b"]))
-	assert.Equal(t, 10, int(nm.down["feature_a,feature_b"]))
-	assert.Equal(t, 40, int(nm.alloc["feature_a,feature_b"]))
-	assert.Equal(t, 20, int(nm.alloc["feature_a"]))
-	assert.Equal(t, 10, int(nm.down["null"]))
-	assert.Equal(t, 42, int(nm.other["null"]))
-	assert.Equal(t, 24, int(nm.other["feature_a"]))
-	assert.Equal(t, 3, int(nm.planned["feature_a"]))
-	assert.Equal(t, 5, int(nm.planned["feature_b"]))
+	partitions := ParseNodesMetrics(ParseNodeList(data))
+	nm := partitions["normal"]
+	assert.Equal(t, 1, int(nm.idle["feature_a"]))
+	assert.Equal(t, 1, int(nm.down["null"]))
+	assert.Equal(t, 1, int(nm.drain["null"]))
+	assert.Equal(t, 1, int(nm.alloc["feature_a,feature_b"]))
+	assert.Equal(t, 1, int(nm.mix["feature_a,feature_b"]))
+	assert.Equal(t, 1, int(nm.planned["feature_a"]))
+	nm = partitions["long"]
+	assert.Equal(t, 1, int(nm.alloc["feature_a"]))
+	assert.Equal(t, 1, int(nm.alloc["feature_a,feature_b"]))
+	assert.Equal(t, 1, int(nm.other["null"]))
+	assert.Equal(t, 2, int(partitions["gpu"].alloc["a100,gpu"]+partitions["gpu"].mix["a100,gpu"]))
 }
@@ -16,137 +16,102 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>. */
 package main
 
 import (
-        "io/ioutil"
-	"os"
-        "os/exec"
-        "log"
-        "strings"
-        "strconv"
-        "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
 )
 
-func PartitionsData() []byte {
-        cmd := exec.Command("/usr/bin/sinfo", "-h", "\"-o%R,%C\"")
-        cmd.Env = append(os.Environ(), "PATH=/usr/bin:/bin:/usr/sbin:/sbin")
-        stdout, err := cmd.StdoutPipe()
-        if err != nil {
-                log.Fatal(err)
-        }
-        if err := cmd.Start(); err != nil {
-                log.Fatal(err)
-        }
-        out, _ := ioutil.ReadAll(stdout)
-        if err := cmd.Wait(); err != nil {
-                log.Fatal(err)
-        }
-        return out
-}
-
-func PartitionsPendingJobsData() []byte {
-        cmd := exec.Command("/usr/bin/squeue","-a","-r","-h","-o%P","--states=PENDING")
-        cmd.Env = append(os.Environ(), "PATH=/usr/bin:/bin:/usr/sbin:/sbin")
-        stdout, err := cmd.StdoutPipe()
-        if err != nil {
-                log.Fatal(err)
-        }
-        if err := cmd.Start(); err != nil {
-                log.Fatal(err)
-        }
-        out, _ := ioutil.ReadAll(stdout)
-        if err := cmd.Wait(); err != nil {
-                log.Fatal(err)
-        }
-        return out
-}
-
 type PartitionMetrics struct {
-        allocated float64
-        idle float64
-        other float64
-        pending float64
-        total float64
+	allocated float64
+	idle      float64
+	other     float64
+	pending   float64
+	total     float64
 }
 
-func ParsePartitionsMetrics() map[string]*PartitionMetrics {
-        partitions := make(map[string]*PartitionMetrics)
-        lines := strings.Split(string(PartitionsData()), "\n")
-        for _, line := range lines {
-                if strings.Contains(line,",") {
-                        // name of a partition
-                        partition := strings.Split(line,",")[0]
-                        _,key := partitions[partition]
-                        if !key {
-                                partitions[partition] = &PartitionMetrics{0,0,0,0,0}
-                        }
-                        states := strings.Split(line,",")[1]
-                        allocated,_ := strconv.ParseFloat(strings.Split(states,"/")[0],64)
-                        idle,_ := strconv.ParseFloat(strings.Split(states,"/")[1],64)
-                        other,_ := strconv.ParseFloat(strings.Split(states,"/")[2],64)
-                        total,_ := strconv.ParseFloat(strings.Split(states,"/")[3],64)
-                        partitions[partition].allocated = allocated
-                        partitions[partition].idle = idle
-                        partitions[partition].other = other
-                        partitions[partition].total = total
-                }
-        }
-        // get list of pending jobs by partition name
-        list := strings.Split(string(PartitionsPendingJobsData()),"\n")
-        for _,partition := range list {
-		// accumulate the number of pending jobs
-		_,key := partitions[partition]
-		if key {
-			partitions[partition].pending += 1
-                }
-        }
-
-
-        return partitions
+func ParsePartitionsMetrics(nodes []Node, jobs []Job) map[string]*PartitionMetrics {
+	partitions := make(map[string]*PartitionMetrics)
+	// sum up the CPUs of the nodes in each partition
+	for _, node := range nodes {
+		_, key := partitions[node.Partition]
+		if !key {
+			partitions[node.Partition] = &PartitionMetrics{0, 0, 0, 0, 0}
+		}
+		partitions[node.Partition].allocated += node.CPUsAlloc
+		partitions[node.Partition].idle += node.CPUsIdle
+		partitions[node.Partition].other += node.CPUsOther
+		partitions[node.Partition].total += node.CPUsTotal
+	}
+	// accumulate the number of pending jobs, a job may be
+	// pending in several partitions
+	for _, job := range jobs {
+		if job.State != "PENDING" {
+			continue
+		}
+		for _, partition := range strings.Split(job.Partition, ",") {
+			_, key := partitions[partition]
+			if key {
+				partitions[partition].pending += 1
+			}
+		}
+	}
+	return partitions
 }
 
 type PartitionsCollector struct {
-        allocated *prometheus.Desc
-        idle *prometheus.Desc
-        other *prometheus.Desc
-        pending *prometheus.Desc
-        total *prometheus.Desc
+	slurm     *Slurm
+	allocated *prometheus.Desc
+	idle      *prometheus.Desc
+	other     *prometheus.Desc
+	pending   *prometheus.Desc
+	total     *prometheus.Desc
 }
 
-func NewPartitionsCollector() *PartitionsCollector {
-        labels := []string{"partition"}
-        return &PartitionsCollector{
-                allocated: prometheus.NewDesc("slurm_partition_cpus_allocated", "Allocated CPUs for partition", labels,nil),
-		idle: prometheus.NewDesc("slurm_partition_cpus_idle", "Idle CPUs for partition", labels,nil),
-		other: prometheus.NewDesc("slurm_partition_cpus_other", "Other CPUs for partition", labels,nil),
-		pending: prometheus.NewDesc("slurm_partition_jobs_pending", "Pending jobs for partition", labels,nil),
-		total: prometheus.NewDesc("slurm_partition_cpus_total", "Total CPUs for partition", labels,nil),
-        }
+func NewPartitionsCollector(slurm *Slurm) *PartitionsCollector {
+	labels := []string{"partition"}
+	return &PartitionsCollector{
+		slurm:     slurm,
+		allocated: prometheus.NewDesc("slurm_partition_cpus_allocated", "Allocated CPUs for partition", labels, nil),
+		idle:      prometheus.NewDesc("slurm_partition_cpus_idle", "Idle CPUs for partition", labels, nil),
+		other:     prometheus.NewDesc("slurm_partition_cpus_other", "Other CPUs for partition", labels, nil),
+		pending:   prometheus.NewDesc("slurm_partition_jobs_pending", "Pending jobs for partition", labels, nil),
+		total:     prometheus.NewDesc("slurm_partition_cpus_total", "Total CPUs for partition", labels, nil),
+	}
 }
 
 func (pc *PartitionsCollector) Describe(ch chan<- *prometheus.Desc) {
-        ch <- pc.allocated
-        ch <- pc.idle
-        ch <- pc.other
-        ch <- pc.pending
-        ch <- pc.total
+	ch <- pc.allocated
+	ch <- pc.idle
+	ch <- pc.other
+	ch <- pc.pending
+	ch <- pc.total
 }
 
-func (pc *PartitionsCollector) Collect(ch chan<- prometheus.Metric) {
-        pm := ParsePartitionsMetrics()
-        for p := range pm {
-                if pm[p].allocated > 0 {
-                        ch <- prometheus.MustNewConstMetric(pc.allocated, prometheus.GaugeValue, pm[p].allocated, p)
-                }
-                if pm[p].idle > 0 {
-                        ch <- prometheus.MustNewConstMetric(pc.idle, prometheus.GaugeValue, pm[p].idle, p)
-                }
-                if pm[p].other > 0 {
-                        ch <- prometheus.MustNewConstMetric(pc.other, prometheus.GaugeValue, pm[p].other, p)
-                }
-                if pm[p].pending > 0 {
-                        ch <- prometheus.MustNewConstMetric(pc.pending, prometheus.GaugeValue, pm[p].pending, p)
-                }
-                if pm[p].total > 0 {
-                        ch <- prometheus.MustNewConstMetric(pc.total, prometheus.GaugeValue, pm[p].total, p)
-                }
-        }
+func (pc *PartitionsCollector) Update(ch chan<- prometheus.Metric) error {
+	nodes, err := pc.slurm.Nodes()
+	if err != nil {
+		return err
+	}
+	jobs, err := pc.slurm.Jobs()
+	if err != nil {
+		return err
+	}
+	pm := ParsePartitionsMetrics(nodes, jobs)
+	for p := range pm {
+		if pm[p].allocated > 0 {
+			ch <- prometheus.MustNewConstMetric(pc.allocated, prometheus.GaugeValue, pm[p].allocated, p)
+		}
+		if pm[p].idle > 0 {
+			ch <- prometheus.MustNewConstMetric(pc.idle, prometheus.GaugeValue, pm[p].idle, p)
+		}
+		if pm[p].other > 0 {
+			ch <- prometheus.MustNewConstMetric(pc.other, prometheus.GaugeValue, pm[p].other, p)
+		}
+		if pm[p].pending > 0 {
+			ch <- prometheus.MustNewConstMetric(pc.pending, prometheus.GaugeValue, pm[p].pending, p)
+		}
+		if pm[p].total > 0 {
+			ch <- prometheus.MustNewConstMetric(pc.total, prometheus.GaugeValue, pm[p].total, p)
+		}
+	}
+	return nil
 }
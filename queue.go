@@ -16,287 +16,249 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>. */
 package main
 
 import (
-	"io/ioutil"
-	"log"
-	"os"
-	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-type NNVal map[string]map[string]map[string]float64
-type NVal map[string]map[string]float64
+// Labels of the queue metrics by default, pending jobs have the reason in
+// addition
+var DefaultQueueLabels = []string{"user", "partition"}
 
-type QueueMetrics struct {
-	pending       NNVal
-	running       NVal
-	suspended     NVal
-	cancelled     NVal
-	completing    NVal
-	completed     NVal
-	configuring   NVal
-	failed        NVal
-	timeout       NVal
-	preempted     NVal
-	node_fail     NVal
-	c_pending     NNVal
-	c_running     NVal
-	c_suspended   NVal
-	c_cancelled   NVal
-	c_completing  NVal
-	c_completed   NVal
-	c_configuring NVal
-	c_failed      NVal
-	c_timeout     NVal
-	c_preempted   NVal
-	c_node_fail   NVal
+// Job states exposed by the queue collector and the help of their metrics
+var queueStates = []struct {
+	state string
+	jobs  string
+	cores string
+}{
+	{"PENDING", "Pending jobs in queue", "Pending cores in queue"},
+	{"RUNNING", "Running jobs in the cluster", "Running cores in the cluster"},
+	{"SUSPENDED", "Suspended jobs in the cluster", "Suspended cores in the cluster"},
+	{"CANCELLED", "Cancelled jobs in the cluster", "Cancelled cores in the cluster"},
+	{"COMPLETING", "Completing jobs in the cluster", "Completing cores in the cluster"},
+	{"COMPLETED", "Completed jobs in the cluster", "Completed cores in the cluster"},
+	{"CONFIGURING", "Configuring jobs in the cluster", "Configuring cores in the cluster"},
+	{"FAILED", "Number of failed jobs", "Number of failed cores"},
+	{"TIMEOUT", "Jobs stopped by timeout", "Cores stopped by timeout"},
+	{"PREEMPTED", "Number of preempted jobs", "Number of preempted cores"},
+	{"NODE_FAIL", "Number of jobs stopped due to node fail", "Number of cores stopped due to node fail"},
 }
 
-// Returns the scheduler metrics
-func QueueGetMetrics() *QueueMetrics {
-	return ParseQueueMetrics(QueueData())
-}
+// QueueMetrics holds the series of every job state by their label values
+type QueueMetrics map[string]map[string]*JobSeries
 
-func (s *NVal) Incr(user string, part string, count float64) {
-	child, ok := (*s)[user]
-	if !ok {
-		child = map[string]float64{}
-		(*s)[user] = child
-		child[part] = 0
+// ParseQueueMetrics sums up the jobs and cores per state and the given
+// labels, the reason is added to the labels of pending jobs
+func ParseQueueMetrics(jobs []Job, labels []string) QueueMetrics {
+	byState := make(map[string][]Job)
+	for _, job := range jobs {
+		byState[job.State] = append(byState[job.State], job)
+	}
+	qm := make(QueueMetrics)
+	for _, s := range queueStates {
+		if s.state == "PENDING" {
+			qm[s.state] = AggregateJobs(byState[s.state], append(append([]string(nil), labels...), "reason"))
+		} else {
+			qm[s.state] = AggregateJobs(byState[s.state], labels)
+		}
 	}
-	child[part] += count
+	return qm
 }
 
-func (s *NNVal) Incr2(reason string, user string, part string, count float64) {
-	_, ok := (*s)[reason]
-	if !ok {
-		child := map[string]map[string]float64{}
-		(*s)[reason] = child
-	}
-	child2, ok := (*s)[reason][user]
-	if !ok {
-		child2 = map[string]float64{}
-		(*s)[reason][user] = child2
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * Slurm queue metrics into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+func NewQueueCollector(slurm *Slurm) *QueueCollector {
+	qc := &QueueCollector{
+		slurm:        slurm,
+		pending_wait: prometheus.NewDesc("slurm_queue_pending_wait_seconds", "Time the pending jobs in queue have been waiting since their submission", []string{"partition", "qos"}, nil),
+		start_wait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "slurm_queue_start_wait_seconds",
+			Help:    "Time the jobs started since the previous scrape have been waiting since their submission",
+			Buckets: WaitBuckets,
+		}, []string{"partition", "qos"}),
+		now: time.Now,
 	}
-	child2[part] += count
+	qc.SetLabels(DefaultQueueLabels)
+	return qc
 }
 
-func ParseQueueMetrics(input []byte) *QueueMetrics {
-	qm := QueueMetrics{
-		pending:       make(NNVal),
-		running:       make(NVal),
-		suspended:     make(NVal),
-		cancelled:     make(NVal),
-		completing:    make(NVal),
-		completed:     make(NVal),
-		configuring:   make(NVal),
-		failed:        make(NVal),
-		timeout:       make(NVal),
-		preempted:     make(NVal),
-		node_fail:     make(NVal),
-		c_pending:     make(NNVal),
-		c_running:     make(NVal),
-		c_suspended:   make(NVal),
-		c_cancelled:   make(NVal),
-		c_completing:  make(NVal),
-		c_completed:   make(NVal),
-		c_configuring: make(NVal),
-		c_failed:      make(NVal),
-		c_timeout:     make(NVal),
-		c_preempted:   make(NVal),
-		c_node_fail:   make(NVal),
-	}
-	lines := strings.Split(string(input), "\n")
-	for _, line := range lines {
-		if strings.Contains(line, ",") {
-			part := strings.Split(line, ",")[0]
-			part = strings.TrimSpace(part)
-			state := strings.Split(line, ",")[1]
-			cores_i, _ := strconv.Atoi(strings.Split(line, ",")[2])
-			cores := float64(cores_i)
-			user := strings.Split(line, ",")[4]
-			user = strings.TrimSpace(user)
-			reason := strings.Split(line, ",")[3]
-			switch state {
-			case "PENDING":
-				qm.pending.Incr2(reason, user, part, 1)
-				qm.c_pending.Incr2(reason, user, part, cores)
-			case "RUNNING":
-				qm.running.Incr(user, part, 1)
-				qm.c_running.Incr(user, part, cores)
-			case "SUSPENDED":
-				qm.suspended.Incr(user, part, 1)
-				qm.suspended.Incr(user, part, cores)
-			case "CANCELLED":
-				qm.cancelled.Incr(user, part, 1)
-				qm.c_cancelled.Incr(user, part, cores)
-			case "COMPLETING":
-				qm.completing.Incr(user, part, 1)
-				qm.c_completing.Incr(user, part, cores)
-			case "COMPLETED":
-				qm.completed.Incr(user, part, 1)
-				qm.c_completed.Incr(user, part, cores)
-			case "CONFIGURING":
-				qm.configuring.Incr(user, part, 1)
-				qm.c_configuring.Incr(user, part, cores)
-			case "FAILED":
-				qm.failed.Incr(user, part, 1)
-				qm.c_failed.Incr(user, part, cores)
-			case "TIMEOUT":
-				qm.timeout.Incr(user, part, 1)
-				qm.c_timeout.Incr(user, part, cores)
-			case "PREEMPTED":
-				qm.preempted.Incr(user, part, 1)
-				qm.c_preempted.Incr(user, part, cores)
-			case "NODE_FAIL":
-				qm.node_fail.Incr(user, part, 1)
-				qm.c_node_fail.Incr(user, part, cores)
-			}
+type QueueCollector struct {
+	slurm        *Slurm
+	labels       []string
+	jobs         map[string]*prometheus.Desc
+	cores        map[string]*prometheus.Desc
+	nodes        map[string]*prometheus.Desc
+	memory       map[string]*prometheus.Desc
+	gpus         map[string]*prometheus.Desc
+	pending_wait *prometheus.Desc
+	start_wait   *prometheus.HistogramVec
+	now          func() time.Time
+
+	// Jobs seen running during the previous update by their id and start
+	// time, nil before the first
+	mu      sync.Mutex
+	started map[string]bool
+}
+
+// SetLabels selects the job attributes exposed as labels of the job counts
+// and requested resources, fewer labels create fewer series
+func (qc *QueueCollector) SetLabels(labels []string) {
+	qc.labels = labels
+	qc.jobs = make(map[string]*prometheus.Desc)
+	qc.cores = make(map[string]*prometheus.Desc)
+	qc.nodes = make(map[string]*prometheus.Desc)
+	qc.memory = make(map[string]*prometheus.Desc)
+	qc.gpus = make(map[string]*prometheus.Desc)
+	for _, s := range queueStates {
+		names := labels
+		if s.state == "PENDING" {
+			names = append(append([]string(nil), labels...), "reason")
 		}
+		name := strings.ToLower(s.state)
+		jobs := strings.Replace(name, "_", " ", -1) + " jobs"
+		qc.jobs[s.state] = prometheus.NewDesc("slurm_queue_"+name, s.jobs, names, nil)
+		qc.cores[s.state] = prometheus.NewDesc("slurm_cores_"+name, s.cores, names, nil)
+		qc.nodes[s.state] = prometheus.NewDesc("slurm_queue_"+name+"_nodes", "Nodes requested by "+jobs, names, nil)
+		qc.memory[s.state] = prometheus.NewDesc("slurm_queue_"+name+"_memory_bytes", "Memory requested by "+jobs, names, nil)
+		qc.gpus[s.state] = prometheus.NewDesc("slurm_queue_"+name+"_gpus", "GPUs requested by "+jobs, names, nil)
 	}
-	return &qm
 }
 
-// Execute the squeue command and return its output
-func QueueData() []byte {
-	cmd := exec.Command("/usr/bin/squeue", "-h", "-o %P,%T,%C,%r,%u")
-	cmd.Env = append(os.Environ(), "PATH=/usr/bin:/bin:/usr/sbin:/sbin")
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
+func (qc *QueueCollector) configure(config *Config) {
+	qc.SetLabels(config.Queue.Labels)
+}
+
+func (qc *QueueCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, s := range queueStates {
+		ch <- qc.jobs[s.state]
+		ch <- qc.cores[s.state]
+		ch <- qc.nodes[s.state]
+		ch <- qc.memory[s.state]
+		ch <- qc.gpus[s.state]
 	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
+	ch <- qc.pending_wait
+	qc.start_wait.Describe(ch)
+}
+
+func (qc *QueueCollector) Update(ch chan<- prometheus.Metric) error {
+	jobs, err := qc.slurm.Jobs()
+	if err != nil {
+		return err
 	}
-	out, _ := ioutil.ReadAll(stdout)
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
+	for state, series := range ParseQueueMetrics(jobs, qc.labels) {
+		for _, s := range series {
+			ch <- prometheus.MustNewConstMetric(qc.jobs[state], prometheus.GaugeValue, s.jobs, s.labels...)
+			ch <- prometheus.MustNewConstMetric(qc.cores[state], prometheus.GaugeValue, s.cores, s.labels...)
+			ch <- prometheus.MustNewConstMetric(qc.nodes[state], prometheus.GaugeValue, s.nodes, s.labels...)
+			ch <- prometheus.MustNewConstMetric(qc.memory[state], prometheus.GaugeValue, s.memory, s.labels...)
+			ch <- prometheus.MustNewConstMetric(qc.gpus[state], prometheus.GaugeValue, s.gpus, s.labels...)
+		}
 	}
-	return out
+	qc.updateWaitTimes(jobs, ch)
+	return nil
 }
 
-/*
- * Implement the Prometheus Collector interface and feed the
- * Slurm queue metrics into it.
- * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
- */
+// Upper bounds of the wait time buckets, from a minute to a week
+var WaitBuckets = []float64{60, 300, 900, 1800, 3600, 7200, 14400, 28800, 43200, 86400, 172800, 345600, 604800}
 
-func NewQueueCollector() *QueueCollector {
-	return &QueueCollector{
-		pending:           prometheus.NewDesc("slurm_queue_pending", "Pending jobs in queue", []string{"user", "partition", "reason"}, nil),
-		running:           prometheus.NewDesc("slurm_queue_running", "Running jobs in the cluster", []string{"user", "partition"}, nil),
-		suspended:         prometheus.NewDesc("slurm_queue_suspended", "Suspended jobs in the cluster", []string{"user", "partition"}, nil),
-		cancelled:         prometheus.NewDesc("slurm_queue_cancelled", "Cancelled jobs in the cluster", []string{"user", "partition"}, nil),
-		completing:        prometheus.NewDesc("slurm_queue_completing", "Completing jobs in the cluster", []string{"user", "partition"}, nil),
-		completed:         prometheus.NewDesc("slurm_queue_completed", "Completed jobs in the cluster", []string{"user", "partition"}, nil),
-		configuring:       prometheus.NewDesc("slurm_queue_configuring", "Configuring jobs in the cluster", []string{"user", "partition"}, nil),
-		failed:            prometheus.NewDesc("slurm_queue_failed", "Number of failed jobs", []string{"user", "partition"}, nil),
-		timeout:           prometheus.NewDesc("slurm_queue_timeout", "Jobs stopped by timeout", []string{"user", "partition"}, nil),
-		preempted:         prometheus.NewDesc("slurm_queue_preempted", "Number of preempted jobs", []string{"user", "partition"}, nil),
-		node_fail:         prometheus.NewDesc("slurm_queue_node_fail", "Number of jobs stopped due to node fail", []string{"user", "partition"}, nil),
-		cores_pending:     prometheus.NewDesc("slurm_cores_pending", "Pending cores in queue", []string{"user", "partition", "reason"}, nil),
-		cores_running:     prometheus.NewDesc("slurm_cores_running", "Running cores in the cluster", []string{"user", "partition"}, nil),
-		cores_suspended:   prometheus.NewDesc("slurm_cores_suspended", "Suspended cores in the cluster", []string{"user", "partition"}, nil),
-		cores_cancelled:   prometheus.NewDesc("slurm_cores_cancelled", "Cancelled cores in the cluster", []string{"user", "partition"}, nil),
-		cores_completing:  prometheus.NewDesc("slurm_cores_completing", "Completing cores in the cluster", []string{"user", "partition"}, nil),
-		cores_completed:   prometheus.NewDesc("slurm_cores_completed", "Completed cores in the cluster", []string{"user", "partition"}, nil),
-		cores_configuring: prometheus.NewDesc("slurm_cores_configuring", "Configuring cores in the cluster", []string{"user", "partition"}, nil),
-		cores_failed:      prometheus.NewDesc("slurm_cores_failed", "Number of failed cores", []string{"user", "partition"}, nil),
-		cores_timeout:     prometheus.NewDesc("slurm_cores_timeout", "Cores stopped by timeout", []string{"user", "partition"}, nil),
-		cores_preempted:   prometheus.NewDesc("slurm_cores_preempted", "Number of preempted cores", []string{"user", "partition"}, nil),
-		cores_node_fail:   prometheus.NewDesc("slurm_cores_node_fail", "Number of cores stopped due to node fail", []string{"user", "partition"}, nil),
-	}
+type waitKey struct {
+	partition string
+	qos       string
 }
 
-type QueueCollector struct {
-	pending           *prometheus.Desc
-	running           *prometheus.Desc
-	suspended         *prometheus.Desc
-	cancelled         *prometheus.Desc
-	completing        *prometheus.Desc
-	completed         *prometheus.Desc
-	configuring       *prometheus.Desc
-	failed            *prometheus.Desc
-	timeout           *prometheus.Desc
-	preempted         *prometheus.Desc
-	node_fail         *prometheus.Desc
-	cores_pending     *prometheus.Desc
-	cores_running     *prometheus.Desc
-	cores_suspended   *prometheus.Desc
-	cores_cancelled   *prometheus.Desc
-	cores_completing  *prometheus.Desc
-	cores_completed   *prometheus.Desc
-	cores_configuring *prometheus.Desc
-	cores_failed      *prometheus.Desc
-	cores_timeout     *prometheus.Desc
-	cores_preempted   *prometheus.Desc
-	cores_node_fail   *prometheus.Desc
+// ParsePendingWaitTimes returns the time every pending job has been waiting
+// by partition and QOS
+func ParsePendingWaitTimes(jobs []Job, now time.Time) map[waitKey][]float64 {
+	waits := make(map[waitKey][]float64)
+	for _, job := range jobs {
+		if job.State != "PENDING" || job.SubmitTime.IsZero() {
+			continue
+		}
+		wait := now.Sub(job.SubmitTime).Seconds()
+		if wait < 0 {
+			wait = 0
+		}
+		key := waitKey{job.Partition, job.QOS}
+		waits[key] = append(waits[key], wait)
+	}
+	return waits
 }
 
-func (qc *QueueCollector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- qc.pending
-	ch <- qc.running
-	ch <- qc.suspended
-	ch <- qc.cancelled
-	ch <- qc.completing
-	ch <- qc.completed
-	ch <- qc.configuring
-	ch <- qc.failed
-	ch <- qc.timeout
-	ch <- qc.preempted
-	ch <- qc.node_fail
-	ch <- qc.cores_pending
-	ch <- qc.cores_running
-	ch <- qc.cores_suspended
-	ch <- qc.cores_cancelled
-	ch <- qc.cores_completing
-	ch <- qc.cores_completed
-	ch <- qc.cores_configuring
-	ch <- qc.cores_failed
-	ch <- qc.cores_timeout
-	ch <- qc.cores_preempted
-	ch <- qc.cores_node_fail
+// Histogram of the wait times of the currently pending jobs, recomputed on
+// every update
+func waitHistogram(desc *prometheus.Desc, waits []float64, labels ...string) prometheus.Metric {
+	sort.Float64s(waits)
+	buckets := make(map[float64]uint64)
+	var sum float64
+	i := 0
+	for _, bound := range WaitBuckets {
+		for i < len(waits) && waits[i] <= bound {
+			i++
+		}
+		buckets[bound] = uint64(i)
+	}
+	for _, wait := range waits {
+		sum += wait
+	}
+	return prometheus.MustNewConstHistogram(desc, uint64(len(waits)), sum, buckets, labels...)
 }
 
-func (qc *QueueCollector) Collect(ch chan<- prometheus.Metric) {
-	qm := QueueGetMetrics()
-	for reason, values := range qm.pending {
-		PushMetric(values, ch, qc.pending, reason)
+// Keep the jobs seen started and the observed wait times across a reload
+func (qc *QueueCollector) seed(other Collector) {
+	previous, ok := other.(*QueueCollector)
+	if !ok {
+		return
 	}
+	previous.mu.Lock()
+	started, startWait := previous.started, previous.start_wait
+	previous.mu.Unlock()
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	qc.started = started
+	qc.start_wait = startWait
+}
 
-	PushMetric(qm.running, ch, qc.running, "")
-	PushMetric(qm.cancelled, ch, qc.cancelled, "")
-	PushMetric(qm.completing, ch, qc.completing, "")
-	PushMetric(qm.completed, ch, qc.completed, "")
-	PushMetric(qm.configuring, ch, qc.configuring, "")
-	PushMetric(qm.failed, ch, qc.failed, "")
-	PushMetric(qm.timeout, ch, qc.timeout, "")
-	PushMetric(qm.preempted, ch, qc.preempted, "")
-	PushMetric(qm.node_fail, ch, qc.node_fail, "")
-	for reason, value := range qm.c_pending {
-		PushMetric(value, ch, qc.cores_pending, reason)
-	}
-	PushMetric(qm.c_running, ch, qc.cores_running, "")
-	PushMetric(qm.c_cancelled, ch, qc.cores_cancelled, "")
-	PushMetric(qm.c_completing, ch, qc.cores_completing, "")
-	PushMetric(qm.c_completed, ch, qc.cores_completed, "")
-	PushMetric(qm.c_configuring, ch, qc.cores_configuring, "")
-	PushMetric(qm.c_failed, ch, qc.cores_failed, "")
-	PushMetric(qm.c_timeout, ch, qc.cores_timeout, "")
-	PushMetric(qm.c_preempted, ch, qc.cores_preempted, "")
-	PushMetric(qm.c_node_fail, ch, qc.cores_node_fail, "")
+// States of the jobs started and not ended yet
+var runningStates = map[string]bool{
+	"RUNNING":     true,
+	"COMPLETING":  true,
+	"SUSPENDED":   true,
+	"CONFIGURING": true,
 }
 
-func PushMetric(m map[string]map[string]float64, ch chan<- prometheus.Metric, coll *prometheus.Desc, a_label string) {
-	for label1, vals1 := range m {
-		for label2, val := range vals1 {
-			if a_label != "" {
-				ch <- prometheus.MustNewConstMetric(coll, prometheus.GaugeValue, val, label1, label2, a_label)
-			} else {
-				ch <- prometheus.MustNewConstMetric(coll, prometheus.GaugeValue, val, label1, label2)
+// Observe the wait time of the jobs started since the previous update. Jobs
+// starting and ending between two updates are missed, the first update only
+// records the jobs already started. A requeued job starting again is
+// observed again by its new start time.
+func (qc *QueueCollector) updateWaitTimes(jobs []Job, ch chan<- prometheus.Metric) {
+	for key, waits := range ParsePendingWaitTimes(jobs, qc.now()) {
+		ch <- waitHistogram(qc.pending_wait, waits, key.partition, key.qos)
+	}
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	started := make(map[string]bool)
+	for _, job := range jobs {
+		if !runningStates[job.State] || job.StartTime.IsZero() || job.SubmitTime.IsZero() {
+			continue
+		}
+		key := job.ID + "@" + strconv.FormatInt(job.StartTime.Unix(), 10)
+		started[key] = true
+		if qc.started != nil && !qc.started[key] {
+			wait := job.StartTime.Sub(job.SubmitTime).Seconds()
+			if wait < 0 {
+				wait = 0
 			}
+			qc.start_wait.WithLabelValues(job.Partition, job.QOS).Observe(wait)
 		}
 	}
+	qc.started = started
+	qc.start_wait.Collect(ch)
 }
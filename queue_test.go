@@ -18,7 +18,12 @@ package main
 import (
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestParseQueueMetrics(t *testing.T) {
@@ -28,5 +33,119 @@ func TestParseQueueMetrics(t *testing.T) {
 		t.Fatalf("Can not open test data: %v", err)
 	}
 	data, err := ioutil.ReadAll(file)
-	t.Logf("%+v", ParseQueueMetrics(data))
+	qm := ParseQueueMetrics(ParseJobs(data), []string{"qos"})
+	assert.Equal(t, &JobSeries{[]string{"high"}, 5, 60, 5, 40 << 30, 0}, qm["RUNNING"]["high"])
+	assert.Equal(t, &JobSeries{[]string{"normal"}, 19, 228, 19, 19 * 4000 << 20, 0}, qm["RUNNING"]["normal"])
+	assert.Equal(t, &JobSeries{[]string{"low", "Licenses"}, 2, 24, 2, 16 << 30, 1}, qm["PENDING"]["low\xffLicenses"])
+	assert.Equal(t, 1, len(qm["SUSPENDED"]))
+}
+
+func TestQueueLabels(t *testing.T) {
+	runner := NewFakeRunner().File(t, "squeue", "test_data/squeue.txt")
+	collector := NewQueueCollector(NewSlurm(NewCommandSource(runner)))
+	collector.SetLabels([]string{"account", "qos"})
+	expected := `
+# HELP slurm_queue_pending Pending jobs in queue
+# TYPE slurm_queue_pending gauge
+slurm_queue_pending{account="chemistry",qos="high",reason="Licenses"} 2
+slurm_queue_pending{account="chemistry",qos="low",reason="Licenses"} 2
+# HELP slurm_cores_running Running cores in the cluster
+# TYPE slurm_cores_running gauge
+slurm_cores_running{account="chemistry",qos="high"} 60
+slurm_cores_running{account="chemistry",qos="low"} 48
+slurm_cores_running{account="physics",qos="normal"} 228
+# HELP slurm_queue_pending_gpus GPUs requested by pending jobs
+# TYPE slurm_queue_pending_gpus gauge
+slurm_queue_pending_gpus{account="chemistry",qos="high",reason="Licenses"} 0
+slurm_queue_pending_gpus{account="chemistry",qos="low",reason="Licenses"} 1
+# HELP slurm_queue_running_memory_bytes Memory requested by running jobs
+# TYPE slurm_queue_running_memory_bytes gauge
+slurm_queue_running_memory_bytes{account="chemistry",qos="high"} 4.294967296e+10
+slurm_queue_running_memory_bytes{account="chemistry",qos="low"} 5.1539607552e+10
+slurm_queue_running_memory_bytes{account="physics",qos="normal"} 7.9691776e+10
+`
+	exporter := NewSlurmExporter(map[string]Collector{"queue": collector})
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected),
+		"slurm_queue_pending", "slurm_cores_running", "slurm_queue_pending_gpus", "slurm_queue_running_memory_bytes"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestQueueWaitTimes(t *testing.T) {
+	runner := NewFakeRunner().File(t, "squeue", "test_data/squeue.txt")
+	slurm := NewSlurm(NewCommandSource(runner))
+	slurm.jobs.maxAge = 0
+	collector := NewQueueCollector(slurm)
+	collector.now = func() time.Time { return time.Date(2021, 3, 1, 10, 0, 0, 0, time.Local) }
+	exporter := NewSlurmExporter(map[string]Collector{"queue": collector})
+	buckets := func(partition, qos string, counts ...string) string {
+		var b strings.Builder
+		for i, bound := range []string{"60", "300", "900", "1800", "3600", "7200", "14400", "28800", "43200", "86400", "172800", "345600", "604800", "+Inf"} {
+			b.WriteString(`slurm_queue_pending_wait_seconds_bucket{partition="` + partition + `",qos="` + qos + `",le="` + bound + `"} ` + counts[i] + "\n")
+		}
+		return b.String()
+	}
+	expected := `
+# HELP slurm_queue_pending_wait_seconds Time the pending jobs in queue have been waiting since their submission
+# TYPE slurm_queue_pending_wait_seconds histogram
+` + buckets("long", "high", "0", "0", "0", "0", "0", "2", "2", "2", "2", "2", "2", "2", "2", "2") + `slurm_queue_pending_wait_seconds_sum{partition="long",qos="high"} 10440
+slurm_queue_pending_wait_seconds_count{partition="long",qos="high"} 2
+` + buckets("long", "low", "0", "0", "0", "0", "0", "2", "2", "2", "2", "2", "2", "2", "2", "2") + `slurm_queue_pending_wait_seconds_sum{partition="long",qos="low"} 10560
+slurm_queue_pending_wait_seconds_count{partition="long",qos="low"} 2
+`
+	// The jobs running on the first update are not observed
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected),
+		"slurm_queue_pending_wait_seconds", "slurm_queue_start_wait_seconds"); err != nil {
+		t.Error(err)
+	}
+
+	// A pending job starts an hour after its submission
+	runner.Output["squeue"] = changeJob(runner.Output["squeue"], "15452423", func(fields []string) {
+		fields[1] = "RUNNING"
+		fields[13] = "2021-03-01T09:31:00"
+	})
+	expected = `
+# HELP slurm_queue_start_wait_seconds Time the jobs started since the previous scrape have been waiting since their submission
+# TYPE slurm_queue_start_wait_seconds histogram
+slurm_queue_start_wait_seconds_bucket{partition="long",qos="low",le="60"} 0
+slurm_queue_start_wait_seconds_bucket{partition="long",qos="low",le="300"} 0
+slurm_queue_start_wait_seconds_bucket{partition="long",qos="low",le="900"} 0
+slurm_queue_start_wait_seconds_bucket{partition="long",qos="low",le="1800"} 0
+slurm_queue_start_wait_seconds_bucket{partition="long",qos="low",le="3600"} 1
+slurm_queue_start_wait_seconds_bucket{partition="long",qos="low",le="7200"} 1
+slurm_queue_start_wait_seconds_bucket{partition="long",qos="low",le="14400"} 1
+slurm_queue_start_wait_seconds_bucket{partition="long",qos="low",le="28800"} 1
+slurm_queue_start_wait_seconds_bucket{partition="long",qos="low",le="43200"} 1
+slurm_queue_start_wait_seconds_bucket{partition="long",qos="low",le="86400"} 1
+slurm_queue_start_wait_seconds_bucket{partition="long",qos="low",le="172800"} 1
+slurm_queue_start_wait_seconds_bucket{partition="long",qos="low",le="345600"} 1
+slurm_queue_start_wait_seconds_bucket{partition="long",qos="low",le="604800"} 1
+slurm_queue_start_wait_seconds_bucket{partition="long",qos="low",le="+Inf"} 1
+slurm_queue_start_wait_seconds_sum{partition="long",qos="low"} 3600
+slurm_queue_start_wait_seconds_count{partition="long",qos="low"} 1
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "slurm_queue_start_wait_seconds"); err != nil {
+		t.Error(err)
+	}
+
+	// The job is requeued and starts again, another job ends without having
+	// been seen running
+	runner.Output["squeue"] = changeJob(runner.Output["squeue"], "15452423", func(fields []string) {
+		fields[13] = "2021-03-01T09:45:00"
+	})
+	runner.Output["squeue"] = changeJob(runner.Output["squeue"], "15452420", func(fields []string) {
+		fields[1] = "CANCELLED"
+		fields[13] = "2021-03-01T09:50:00"
+	})
+	expected = strings.NewReplacer(
+		`le="7200"} 1`, `le="7200"} 2`,
+		`sum{partition="long",qos="low"} 3600`, `sum{partition="long",qos="low"} 8040`,
+		`count{partition="long",qos="low"} 1`, `count{partition="long",qos="low"} 2`,
+	).Replace(expected)
+	for _, bound := range []string{"14400", "28800", "43200", "86400", "172800", "345600", "604800", "+Inf"} {
+		expected = strings.Replace(expected, `le="`+bound+`"} 1`, `le="`+bound+`"} 2`, 1)
+	}
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "slurm_queue_start_wait_seconds"); err != nil {
+		t.Error(err)
+	}
 }
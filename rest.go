@@ -0,0 +1,150 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+ * The RestSource reads the Slurm data from the REST API of slurmrestd
+ * instead of running the Slurm commands, e.g. for an exporter running in a
+ * container without the Slurm client tools or munge. The responses are
+ * converted into the same structures the command output is parsed into,
+ * so all collectors expose the same metrics with both sources.
+ */
+
+type RestSource struct {
+	// Base URL of slurmrestd, e.g. http://slurmrestd:6820
+	URL string
+	// Version of the Slurm REST API, e.g. v0.0.40
+	Version string
+	// Name of the user sent along with the token, optional
+	User string
+	// File holding the JWT, SLURM_JWT is used if empty
+	TokenFile string
+	Client    *http.Client
+}
+
+func NewRestSource(url string) *RestSource {
+	return &RestSource{
+		URL:     strings.TrimRight(url, "/"),
+		Version: "v0.0.40",
+		Client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// The token is read on every request so rotated tokens are picked up
+func (s *RestSource) token() (string, error) {
+	if s.TokenFile == "" {
+		return os.Getenv("SLURM_JWT"), nil
+	}
+	data, err := ioutil.ReadFile(s.TokenFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Query an endpoint of the Slurm API and return the body of the response
+func (s *RestSource) get(endpoint string) ([]byte, error) {
+	url := fmt.Sprintf("%s/slurm/%s/%s", s.URL, s.Version, endpoint)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	token, err := s.token()
+	if err != nil {
+		return nil, fmt.Errorf("%s: reading token: %v", url, err)
+	}
+	if token != "" {
+		req.Header.Set("X-SLURM-USER-TOKEN", token)
+	}
+	if s.User != "" {
+		req.Header.Set("X-SLURM-USER-NAME", s.User)
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", url, err)
+	}
+	if err := CheckJSONErrors(body); err != nil {
+		return nil, fmt.Errorf("%s: %v", url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return body, nil
+}
+
+func (s *RestSource) Jobs() ([]Job, error) {
+	data, err := s.get("jobs")
+	if err != nil {
+		return nil, err
+	}
+	return ParseJobsJSON(data)
+}
+
+func (s *RestSource) Nodes() ([]Node, error) {
+	data, err := s.get("nodes")
+	if err != nil {
+		return nil, err
+	}
+	return ParseNodesJSON(data)
+}
+
+func (s *RestSource) Diag() (*SchedulerMetrics, error) {
+	data, err := s.get("diag")
+	if err != nil {
+		return nil, err
+	}
+	return ParseDiagJSON(data)
+}
+
+func (s *RestSource) Shares() (map[string]*FairShareMetrics, error) {
+	data, err := s.get("shares")
+	if err != nil {
+		return nil, err
+	}
+	return ParseSharesJSON(data)
+}
+
+// The API has no equivalent of sacct, the GPUs in use are summed up from
+// the generic resources used on every node instead
+func (s *RestSource) AllocatedGPUs() (float64, error) {
+	nodes, err := s.Nodes()
+	if err != nil {
+		return 0, err
+	}
+	return ParseUsedGPUs(nodes), nil
+}
+
+func (s *RestSource) Controllers() ([]Controller, error) {
+	data, err := s.get("ping")
+	if err != nil {
+		return nil, err
+	}
+	return ParsePingJSON(data)
+}
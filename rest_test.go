@@ -0,0 +1,232 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// Stand-in for slurmrestd serving the recorded responses in test_data/slurmrestd
+func restServer(token string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-SLURM-USER-TOKEN") != token {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"errors":[{"error":"Authentication failure","error_number":1007}]}`))
+			return
+		}
+		data, err := ioutil.ReadFile(filepath.Join("test_data/slurmrestd", filepath.Base(r.URL.Path)+".json"))
+		if err != nil || !strings.HasPrefix(r.URL.Path, "/slurm/v0.0.40/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	}))
+}
+
+func TestRestNumber(t *testing.T) {
+	var v struct {
+		Plain    jsonNumber `json:"plain"`
+		Set      jsonNumber `json:"set"`
+		Unset    jsonNumber `json:"unset"`
+		Infinite jsonNumber `json:"infinite"`
+		Null     jsonNumber `json:"null"`
+	}
+	err := json.Unmarshal([]byte(`{
+		"plain": 12,
+		"set": {"set": true, "infinite": false, "number": 34},
+		"unset": {"set": false, "infinite": false, "number": 56},
+		"infinite": {"set": true, "infinite": true, "number": 0},
+		"null": null}`), &v)
+	assert.Nil(t, err)
+	assert.Equal(t, jsonNumber(12), v.Plain)
+	assert.Equal(t, jsonNumber(34), v.Set)
+	assert.Equal(t, jsonNumber(0), v.Unset)
+	assert.Equal(t, jsonNumber(0), v.Infinite)
+	assert.Equal(t, jsonNumber(0), v.Null)
+}
+
+func TestRestNodeState(t *testing.T) {
+	var v struct {
+		Old jsonStrings `json:"old"`
+		New jsonStrings `json:"new"`
+	}
+	err := json.Unmarshal([]byte(`{"old": "idle", "new": ["IDLE", "DRAIN"]}`), &v)
+	assert.Nil(t, err)
+	assert.Equal(t, "idle", jsonNodeState(v.Old))
+	assert.Equal(t, "drained", jsonNodeState(v.New))
+	assert.Equal(t, "draining", jsonNodeState(jsonStrings{"MIXED", "DRAIN"}))
+	assert.Equal(t, "down*", jsonNodeState(jsonStrings{"DOWN", "NOT_RESPONDING"}))
+	assert.Equal(t, "planned", jsonNodeState(jsonStrings{"IDLE", "PLANNED"}))
+}
+
+// The JSON jobs match the squeue output, the recorded times are in UTC
+func TestParseJobsJSON(t *testing.T) {
+	text, _ := ioutil.ReadFile("test_data/squeue.txt")
+	data, _ := ioutil.ReadFile("test_data/slurmrestd/jobs.json")
+	jobs, err := ParseJobsJSON(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout := "2006-01-02T15:04:05"
+	for i, expected := range ParseJobs(text) {
+		job := jobs[i]
+		assert.Equal(t, expected.SubmitTime.Format(layout), job.SubmitTime.UTC().Format(layout), job.ID)
+		assert.Equal(t, expected.StartTime.IsZero(), job.StartTime.IsZero(), job.ID)
+		if !job.StartTime.IsZero() {
+			assert.Equal(t, expected.StartTime.Format(layout), job.StartTime.UTC().Format(layout), job.ID)
+		}
+		expected.SubmitTime, expected.StartTime, expected.Elapsed = job.SubmitTime, job.StartTime, job.Elapsed
+		// squeue -O lists either the requested or the allocated TRES
+		if job.State == "PENDING" {
+			expected.AllocTRES = job.AllocTRES
+		} else {
+			expected.ReqTRES = job.ReqTRES
+		}
+		assert.Equal(t, expected, job)
+	}
+	// Memory requested per CPU
+	assert.Equal(t, float64(24<<30), jobs[23].Memory)
+	assert.Equal(t, float64(8<<30), jobs[31].Memory)
+	assert.Equal(t, TRES{"billing": 12, "cpu": 12, "gres/gpu": 4, "mem": 24 << 30, "node": 2}, jobs[23].AllocTRES)
+	assert.Equal(t, TRES{"billing": 12, "cpu": 12, "gres/gpu": 1, "gres/gpu:a100": 1, "mem": 8 << 30, "node": 1}, jobs[31].ReqTRES)
+	assert.Equal(t, TRES{}, jobs[31].AllocTRES)
+}
+
+func TestParseJobsJSONArrays(t *testing.T) {
+	jobs, err := ParseJobsJSON([]byte(`{"jobs": [
+	{"job_id": 100, "array_job_id": {"set": true, "number": 100}, "array_task_id": {"set": false, "number": 0}, "array_task_string": "2,4-5%2", "job_state": ["PENDING"], "cpus": 2},
+	{"job_id": 101, "array_job_id": {"set": true, "number": 100}, "array_task_id": {"set": true, "number": 0}, "job_state": ["RUNNING"]},
+	{"job_id": 102, "array_job_id": {"set": true, "number": 100}, "array_task_id": {"set": true, "number": 1}, "job_state": ["RUNNING"]},
+	{"job_id": 200, "array_job_id": 200, "array_task_id": null, "array_task_string": "1-7:3", "job_state": "PENDING"},
+	{"job_id": 201, "array_job_id": 200, "array_task_id": 0, "job_state": "RUNNING"},
+	{"job_id": 300, "array_job_id": 0, "array_task_id": 4294967294, "job_state": "RUNNING"}
+]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, job := range jobs {
+		ids = append(ids, job.ID)
+	}
+	// One job per pending task like squeue -r
+	assert.Equal(t, []string{"100_2", "100_4", "100_5", "100_0", "100_1", "200_1", "200_4", "200_7", "200_0", "300"}, ids)
+	assert.Equal(t, 2.0, jobs[2].CPUs)
+	_, err = ParseJobsJSON([]byte(`{"jobs": [{"job_id": 100, "array_job_id": 100, "array_task_string": "1-x"}]}`))
+	assert.Error(t, err)
+}
+
+func TestParseDiagJSON(t *testing.T) {
+	text, _ := ioutil.ReadFile("test_data/sdiag.txt")
+	data, _ := ioutil.ReadFile("test_data/slurmrestd/diag.json")
+	sm, err := ParseDiagJSON(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1491955200.0, sm.stats_since)
+	assert.Equal(t, 1491987801.0, sm.backfill_last_cycle_when)
+	assert.Equal(t, map[string]string{"REQUEST_NODE_INFO_SINGLE": "2007", "REQUEST_PARTITION_INFO": "2009", "REQUEST_SUBMIT_BATCH_JOB": "4003", "REQUEST_TERMINATE_JOB": "6011"}, sm.rpc_type_ids)
+	assert.Equal(t, map[string]float64{"REQUEST_TERMINATE_JOB": 3}, sm.rpc_pending)
+	// The text output holds the dates in local time
+	expected := ParseSchedulerMetrics(text)
+	expected.stats_since, expected.backfill_last_cycle_when = sm.stats_since, sm.backfill_last_cycle_when
+	assert.Equal(t, expected, sm)
+}
+
+func TestRestSource(t *testing.T) {
+	server := restServer("secret")
+	defer server.Close()
+	token := filepath.Join(t.TempDir(), "token")
+	ioutil.WriteFile(token, []byte("secret\n"), 0600)
+	source := NewRestSource(server.URL)
+	source.TokenFile = token
+
+	names := []string{"accounts", "controllers", "cpus", "fairshare", "gpus", "node", "nodes", "partitions", "queue", "scheduler", "users"}
+	collectors, err := NewCollectors(source, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := NewSlurmExporter(collectors)
+	expected := `
+# HELP slurm_account_fairshare FairShare for account
+# TYPE slurm_account_fairshare gauge
+slurm_account_fairshare{account="chemistry"} 0.25
+slurm_account_fairshare{account="physics"} 0.712121
+slurm_account_fairshare{account="root"} 1
+# HELP slurm_account_jobs_pending Pending jobs for account
+# TYPE slurm_account_jobs_pending gauge
+slurm_account_jobs_pending{account="chemistry"} 4
+# HELP slurm_controller_latency_seconds Round-trip time of the ping of the slurmctld
+# TYPE slurm_controller_latency_seconds gauge
+slurm_controller_latency_seconds{host="ctl1",mode="primary"} 0.001587
+slurm_controller_latency_seconds{host="ctl2",mode="backup"} 0.00221
+# HELP slurm_controller_primary Whether the slurmctld currently serves the cluster, the first one responding
+# TYPE slurm_controller_primary gauge
+slurm_controller_primary{host="ctl1",mode="primary"} 1
+slurm_controller_primary{host="ctl2",mode="backup"} 0
+# HELP slurm_cpus_alloc Allocated CPUs
+# TYPE slurm_cpus_alloc gauge
+slurm_cpus_alloc 128
+# HELP slurm_gpus_alloc Allocated GPUs
+# TYPE slurm_gpus_alloc gauge
+slurm_gpus_alloc 6
+# HELP slurm_gpus_total Total GPUs
+# TYPE slurm_gpus_total gauge
+slurm_gpus_total 10
+# HELP slurm_nodes_total Total number of nodes
+# TYPE slurm_nodes_total gauge
+slurm_nodes_total 11
+# HELP slurm_partition_cpus_total Total CPUs for partition
+# TYPE slurm_partition_cpus_total gauge
+slurm_partition_cpus_total{partition="gpu"} 128
+slurm_partition_cpus_total{partition="long"} 96
+slurm_partition_cpus_total{partition="normal"} 96
+# HELP slurm_scheduler_backfill_mean_cycle Information provided by the Slurm sdiag command, scheduler backfill mean cycle time in (microseconds)
+# TYPE slurm_scheduler_backfill_mean_cycle gauge
+slurm_scheduler_backfill_mean_cycle 1.96082e+06
+# HELP slurm_user_jobs_running Running jobs for user
+# TYPE slurm_user_jobs_running gauge
+slurm_user_jobs_running{user="bar"} 9
+slurm_user_jobs_running{user="foo"} 19
+# HELP slurm_user_rpc_stats Information provided by the Slurm sdiag command, rpc count statistic per user
+# TYPE slurm_user_rpc_stats gauge
+slurm_user_rpc_stats{user="foo"} 6382
+slurm_user_rpc_stats{user="root"} 45219
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected),
+		"slurm_account_fairshare", "slurm_account_jobs_pending", "slurm_controller_latency_seconds",
+		"slurm_controller_primary", "slurm_cpus_alloc", "slurm_gpus_alloc",
+		"slurm_gpus_total", "slurm_nodes_total", "slurm_partition_cpus_total",
+		"slurm_scheduler_backfill_mean_cycle", "slurm_user_jobs_running", "slurm_user_rpc_stats"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRestSourceError(t *testing.T) {
+	server := restServer("secret")
+	defer server.Close()
+	source := NewRestSource(server.URL)
+	_, err := source.Jobs()
+	assert.EqualError(t, err, server.URL+"/slurm/v0.0.40/jobs: Authentication failure")
+}
@@ -0,0 +1,224 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Runner executes a Slurm command line tool and returns its standard
+// output. Every collector goes through a Runner instead of calling
+// exec.Command itself, so tests can inject canned command output.
+type Runner interface {
+	Run(command string, args ...string) ([]byte, error)
+}
+
+// CommandError is returned when a Slurm command could not be started,
+// exited with a non-zero status or ran into its timeout.
+type CommandError struct {
+	Command string
+	Args    []string
+	Err     error
+	Stderr  string
+	// Output of a command exiting with a non-zero status
+	Stdout []byte
+}
+
+func (e *CommandError) Error() string {
+	msg := fmt.Sprintf("%s %s: %v", e.Command, strings.Join(e.Args, " "), e.Err)
+	if e.Stderr != "" {
+		msg += ": " + e.Stderr
+	}
+	return msg
+}
+
+// ExecRunner runs the Slurm commands as child processes.
+type ExecRunner struct {
+	// Directory holding the Slurm binaries
+	BinDir string
+	// Absolute path of individual binaries, overriding BinDir
+	Paths map[string]string
+	// Default timeout of a command, zero means no timeout
+	Timeout time.Duration
+	// Timeout of individual commands, overriding Timeout
+	Timeouts map[string]time.Duration
+}
+
+func NewExecRunner() *ExecRunner {
+	return &ExecRunner{
+		BinDir:   "/usr/bin",
+		Paths:    make(map[string]string),
+		Timeout:  30 * time.Second,
+		Timeouts: make(map[string]time.Duration),
+	}
+}
+
+// Path returns the location of the binary for the given command name.
+func (r *ExecRunner) Path(command string) string {
+	if path, ok := r.Paths[command]; ok {
+		return path
+	}
+	return filepath.Join(r.BinDir, command)
+}
+
+func (r *ExecRunner) timeout(command string) time.Duration {
+	if timeout, ok := r.Timeouts[command]; ok {
+		return timeout
+	}
+	return r.Timeout
+}
+
+func (r *ExecRunner) Run(command string, args ...string) ([]byte, error) {
+	ctx := context.Background()
+	if timeout := r.timeout(command); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	path := r.Path(command)
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Env = append(os.Environ(), "PATH=/usr/bin:/bin:/usr/sbin:/sbin")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// Do not wait forever for children of a killed command still holding
+	// on to stdout/stderr
+	cmd.WaitDelay = time.Second
+	if err := cmd.Run(); err != nil {
+		cerr := &CommandError{
+			Command: path,
+			Args:    args,
+			Err:     err,
+			Stderr:  strings.TrimSpace(stderr.String()),
+			Stdout:  stdout.Bytes(),
+		}
+		// The output of a killed command is incomplete
+		if ctx.Err() == context.DeadlineExceeded {
+			cerr.Err = fmt.Errorf("timed out after %v", r.timeout(command))
+			cerr.Stdout = nil
+		}
+		return nil, cerr
+	}
+	return stdout.Bytes(), nil
+}
+
+/*
+ * The InstrumentedRunner wraps another Runner and counts the executions,
+ * failures and runtime of every Slurm command. It implements the
+ * Prometheus Collector interface to expose those counters.
+ */
+
+type InstrumentedRunner struct {
+	runner     Runner
+	executions *prometheus.CounterVec
+	errors     *prometheus.CounterVec
+	duration   *prometheus.CounterVec
+}
+
+func NewInstrumentedRunner(runner Runner) *InstrumentedRunner {
+	labels := []string{"command"}
+	return &InstrumentedRunner{
+		runner: runner,
+		executions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "slurm_exporter_command_executions_total",
+			Help: "Number of executions of a Slurm command",
+		}, labels),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "slurm_exporter_command_errors_total",
+			Help: "Number of executions of a Slurm command which failed or timed out",
+		}, labels),
+		duration: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "slurm_exporter_command_duration_seconds_total",
+			Help: "Total time spent executing a Slurm command",
+		}, labels),
+	}
+}
+
+// Subcommands exiting with a non-zero status although their output is
+// complete, not counted as errors if they printed anything
+var outputOnError = map[string]bool{
+	// A controller is down
+	"scontrol ping": true,
+}
+
+// Flags given with their value as the next argument
+var flagsWithValue = map[string]bool{
+	"-M":         true,
+	"--clusters": true,
+}
+
+// Whether the command failed without an output to use, judged by the
+// command line which was run, including the arguments added by wrapping runners
+func commandFailed(err error) bool {
+	cerr, ok := err.(*CommandError)
+	if !ok || len(cerr.Stdout) == 0 {
+		return err != nil
+	}
+	words := []string{filepath.Base(cerr.Command)}
+	for i := 0; i < len(cerr.Args); i++ {
+		if flagsWithValue[cerr.Args[i]] {
+			i++
+		} else if !strings.HasPrefix(cerr.Args[i], "-") {
+			words = append(words, cerr.Args[i])
+		}
+	}
+	return !outputOnError[strings.Join(words, " ")]
+}
+
+func (r *InstrumentedRunner) Run(command string, args ...string) ([]byte, error) {
+	start := time.Now()
+	out, err := r.runner.Run(command, args...)
+	r.duration.WithLabelValues(command).Add(time.Since(start).Seconds())
+	r.executions.WithLabelValues(command).Inc()
+	if commandFailed(err) {
+		r.errors.WithLabelValues(command).Inc()
+	}
+	return out, err
+}
+
+// Send all metric descriptions
+func (r *InstrumentedRunner) Describe(ch chan<- *prometheus.Desc) {
+	r.executions.Describe(ch)
+	r.errors.Describe(ch)
+	r.duration.Describe(ch)
+}
+
+// Send the values of all metrics
+func (r *InstrumentedRunner) Collect(ch chan<- prometheus.Metric) {
+	r.executions.Collect(ch)
+	r.errors.Collect(ch)
+	r.duration.Collect(ch)
+}
+
+// ClusterRunner runs the Slurm commands against a single cluster of a
+// multi-cluster setup by passing -M <cluster> to every command.
+type ClusterRunner struct {
+	Runner
+	Cluster string
+}
+
+func (r *ClusterRunner) Run(command string, args ...string) ([]byte, error) {
+	return r.Runner.Run(command, append([]string{"-M", r.Cluster}, args...)...)
+}
@@ -0,0 +1,165 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// FakeRunner replays canned output instead of executing Slurm commands.
+// Output is looked up by the full command line first, then by the name of
+// the command alone. Collectors run concurrently, the maps and calls are
+// guarded by the mutex.
+type FakeRunner struct {
+	mu     sync.Mutex
+	Output map[string][]byte
+	Errors map[string]error
+	Calls  []string
+}
+
+func NewFakeRunner() *FakeRunner {
+	return &FakeRunner{
+		Output: make(map[string][]byte),
+		Errors: make(map[string]error),
+	}
+}
+
+// File registers the content of a test data file as output of a command.
+func (f *FakeRunner) File(t *testing.T, command string, path string) *FakeRunner {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Output[command] = data
+	return f
+}
+
+func (f *FakeRunner) Run(command string, args ...string) ([]byte, error) {
+	line := strings.Join(append([]string{command}, args...), " ")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, line)
+	for _, key := range []string{line, command} {
+		if err, ok := f.Errors[key]; ok {
+			return nil, err
+		}
+		if out, ok := f.Output[key]; ok {
+			return out, nil
+		}
+	}
+	return nil, fmt.Errorf("fake runner: no output for %q", line)
+}
+
+func TestExecRunnerCapturesStderr(t *testing.T) {
+	runner := NewExecRunner()
+	runner.Paths["sh"] = "/bin/sh"
+	_, err := runner.Run("sh", "-c", "echo 'slurm_load_jobs error' >&2; exit 1")
+	if assert.Error(t, err) {
+		cerr, ok := err.(*CommandError)
+		assert.True(t, ok)
+		assert.Equal(t, "slurm_load_jobs error", cerr.Stderr)
+		assert.Contains(t, err.Error(), "slurm_load_jobs error")
+	}
+}
+
+func TestExecRunnerCapturesStdout(t *testing.T) {
+	runner := NewExecRunner()
+	runner.Paths["sh"] = "/bin/sh"
+	out, err := runner.Run("sh", "-c", "echo 'Slurmctld(primary) at ctl1 is DOWN'; exit 1")
+	assert.Nil(t, out)
+	if assert.Error(t, err) {
+		cerr, ok := err.(*CommandError)
+		assert.True(t, ok)
+		assert.Equal(t, "Slurmctld(primary) at ctl1 is DOWN\n", string(cerr.Stdout))
+	}
+}
+
+func TestExecRunnerTimeout(t *testing.T) {
+	runner := NewExecRunner()
+	runner.Paths["sh"] = "/bin/sh"
+	runner.Timeouts["sh"] = 100 * time.Millisecond
+	start := time.Now()
+	_, err := runner.Run("sh", "-c", "sleep 5")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "timed out")
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestExecRunnerPath(t *testing.T) {
+	runner := NewExecRunner()
+	runner.BinDir = "/opt/slurm/bin"
+	runner.Paths["sdiag"] = "/usr/local/bin/sdiag"
+	assert.Equal(t, "/opt/slurm/bin/squeue", runner.Path("squeue"))
+	assert.Equal(t, "/usr/local/bin/sdiag", runner.Path("sdiag"))
+}
+
+func TestInstrumentedRunner(t *testing.T) {
+	fake := NewFakeRunner()
+	fake.Output["sinfo"] = []byte("5725/877/34/6636\n")
+	fake.Errors["sdiag"] = errors.New("slurm_get_statistics: Unable to contact slurm controller")
+	// scontrol ping exits with an error if a controller is down
+	fake.Errors["scontrol --json ping"] = &CommandError{Command: "scontrol", Args: []string{"--json", "ping"}, Err: errors.New("exit status 1"), Stdout: []byte("{}")}
+	fake.Errors["scontrol show config"] = &CommandError{Command: "scontrol", Args: []string{"show", "config"}, Err: errors.New("exit status 1"), Stdout: []byte("partial")}
+	runner := NewInstrumentedRunner(fake)
+	runner.Run("sinfo", "-h", "-o %C")
+	runner.Run("sinfo", "-h", "-o %C")
+	runner.Run("sdiag")
+	runner.Run("scontrol", "--json", "ping")
+	runner.Run("scontrol", "show", "config")
+	expected := `
+# HELP slurm_exporter_command_errors_total Number of executions of a Slurm command which failed or timed out
+# TYPE slurm_exporter_command_errors_total counter
+slurm_exporter_command_errors_total{command="scontrol"} 1
+slurm_exporter_command_errors_total{command="sdiag"} 1
+# HELP slurm_exporter_command_executions_total Number of executions of a Slurm command
+# TYPE slurm_exporter_command_executions_total counter
+slurm_exporter_command_executions_total{command="scontrol"} 2
+slurm_exporter_command_executions_total{command="sdiag"} 1
+slurm_exporter_command_executions_total{command="sinfo"} 2
+`
+	if err := testutil.CollectAndCompare(runner, strings.NewReader(expected),
+		"slurm_exporter_command_executions_total", "slurm_exporter_command_errors_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInstrumentedClusterRunner(t *testing.T) {
+	fake := NewFakeRunner()
+	fake.Errors["scontrol -M alpha ping"] = &CommandError{Command: "/opt/slurm/bin/scontrol", Args: []string{"-M", "alpha", "ping"}, Err: errors.New("exit status 1"), Stdout: []byte("Slurmctld(primary) at alpha-ctl1 is DOWN\n")}
+	fake.Errors["scontrol -M alpha show config"] = &CommandError{Command: "scontrol", Args: []string{"-M", "alpha", "show", "config"}, Err: errors.New("exit status 1"), Stdout: []byte("partial")}
+	runner := NewInstrumentedRunner(&ClusterRunner{Runner: fake, Cluster: "alpha"})
+	runner.Run("scontrol", "ping")
+	runner.Run("scontrol", "show", "config")
+	expected := `
+# HELP slurm_exporter_command_errors_total Number of executions of a Slurm command which failed or timed out
+# TYPE slurm_exporter_command_errors_total counter
+slurm_exporter_command_errors_total{command="scontrol"} 1
+`
+	if err := testutil.CollectAndCompare(runner, strings.NewReader(expected), "slurm_exporter_command_errors_total"); err != nil {
+		t.Error(err)
+	}
+}
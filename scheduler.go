@@ -16,15 +16,14 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>. */
 package main
 
 import (
-	"io/ioutil"
-	"os"
-	"os/exec"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
 )
 
 /*
@@ -37,109 +36,158 @@ import (
 type SchedulerMetrics struct {
 	threads                           float64
 	queue_size                        float64
+	agent_count                       float64
+	agent_thread_count                float64
 	dbd_queue_size                    float64
+	jobs_submitted                    float64
+	jobs_started                      float64
+	jobs_completed                    float64
+	jobs_canceled                     float64
+	jobs_failed                       float64
+	jobs_pending                      float64
+	jobs_running                      float64
 	last_cycle                        float64
+	max_cycle                         float64
+	total_cycles                      float64
 	mean_cycle                        float64
+	mean_depth_cycle                  float64
 	cycle_per_minute                  float64
+	last_queue_length                 float64
+	backfill_total_cycles             float64
+	backfill_last_cycle_when          float64
 	backfill_last_cycle               float64
+	backfill_max_cycle                float64
 	backfill_mean_cycle               float64
+	backfill_last_depth_cycle         float64
+	backfill_last_depth_cycle_try     float64
 	backfill_depth_mean               float64
+	backfill_depth_mean_try           float64
+	backfill_last_queue_length        float64
+	backfill_queue_length_mean        float64
+	backfill_last_table_size          float64
+	backfill_mean_table_size          float64
 	total_backfilled_jobs_since_start float64
 	total_backfilled_jobs_since_cycle float64
 	total_backfilled_heterogeneous    float64
-	rpc_stats_count                   map[string]float64
-	rpc_stats_avg_time                map[string]float64
-	rpc_stats_total_time              map[string]float64
-	user_rpc_stats_count              map[string]float64
-	user_rpc_stats_avg_time           map[string]float64
-	user_rpc_stats_total_time         map[string]float64
+	// Start of the statistics as Unix time, reset daily and by sdiag -r
+	stats_since               float64
+	rpc_stats_count           map[string]float64
+	rpc_stats_avg_time        map[string]float64
+	rpc_stats_total_time      map[string]float64
+	user_rpc_stats_count      map[string]float64
+	user_rpc_stats_avg_time   map[string]float64
+	user_rpc_stats_total_time map[string]float64
+	// Pending RPCs by message type
+	rpc_pending map[string]float64
+	// Ids of the message types and users, empty if not reported
+	rpc_type_ids map[string]string
+	user_rpc_ids map[string]string
 }
 
 // Execute the sdiag command and return its output
-func SchedulerData() []byte {
-	cmd := exec.Command("/usr/bin/sdiag")
-	cmd.Env = append(os.Environ(), "PATH=/usr/bin:/bin:/usr/sbin:/sbin")
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
-	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
-	}
-	out, _ := ioutil.ReadAll(stdout)
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
-	}
-	return out
+func SchedulerData(runner Runner) ([]byte, error) {
+	return runner.Run("sdiag")
 }
 
 // Extract the relevant metrics from the sdiag output
 func ParseSchedulerMetrics(input []byte) *SchedulerMetrics {
 	var sm SchedulerMetrics
 	lines := strings.Split(string(input), "\n")
-	// Guard variables to check for string repetitions in the output of sdiag
-	// (two occurencies of the following strings: 'Last cycle', 'Mean cycle')
-	lc_count := 0
-	mc_count := 0
+	// Fields by section of the sdiag output, the main scheduler and the
+	// backfill sections share names like 'Last cycle' and 'Mean cycle'
+	sections := map[string]map[string]*float64{
+		"general": {
+			"Server thread count":  &sm.threads,
+			"Agent queue size":     &sm.queue_size,
+			"Agent count":          &sm.agent_count,
+			"Agent thread count":   &sm.agent_thread_count,
+			"DBD Agent queue size": &sm.dbd_queue_size,
+			"Jobs submitted":       &sm.jobs_submitted,
+			"Jobs started":         &sm.jobs_started,
+			"Jobs completed":       &sm.jobs_completed,
+			"Jobs canceled":        &sm.jobs_canceled,
+			"Jobs failed":          &sm.jobs_failed,
+			"Jobs pending":         &sm.jobs_pending,
+			"Jobs running":         &sm.jobs_running,
+		},
+		"main": {
+			"Last cycle":        &sm.last_cycle,
+			"Max cycle":         &sm.max_cycle,
+			"Total cycles":      &sm.total_cycles,
+			"Mean cycle":        &sm.mean_cycle,
+			"Mean depth cycle":  &sm.mean_depth_cycle,
+			"Cycles per minute": &sm.cycle_per_minute,
+			"Last queue length": &sm.last_queue_length,
+		},
+		"backfill": {
+			"Total backfilled jobs (since last slurm start)":       &sm.total_backfilled_jobs_since_start,
+			"Total backfilled jobs (since last stats cycle start)": &sm.total_backfilled_jobs_since_cycle,
+			"Total backfilled heterogeneous job components":        &sm.total_backfilled_heterogeneous,
+			"Total cycles":                 &sm.backfill_total_cycles,
+			"Last cycle":                   &sm.backfill_last_cycle,
+			"Max cycle":                    &sm.backfill_max_cycle,
+			"Mean cycle":                   &sm.backfill_mean_cycle,
+			"Last depth cycle":             &sm.backfill_last_depth_cycle,
+			"Last depth cycle (try sched)": &sm.backfill_last_depth_cycle_try,
+			"Depth Mean":                   &sm.backfill_depth_mean,
+			"Depth Mean (try depth)":       &sm.backfill_depth_mean_try,
+			"Last queue length":            &sm.backfill_last_queue_length,
+			"Queue length mean":            &sm.backfill_queue_length_mean,
+			"Last table size":              &sm.backfill_last_table_size,
+			"Mean table size":              &sm.backfill_mean_table_size,
+		},
+	}
+	section := "general"
 	for _, line := range lines {
-		if strings.Contains(line, ":") {
-			state := strings.Split(line, ":")[0]
-			st := regexp.MustCompile(`^Server thread`)
-			qs := regexp.MustCompile(`^Agent queue`)
-			dbd := regexp.MustCompile(`^DBD Agent`)
-			lc := regexp.MustCompile(`^[\s]+Last cycle$`)
-			mc := regexp.MustCompile(`^[\s]+Mean cycle$`)
-			cpm := regexp.MustCompile(`^[\s]+Cycles per`)
-			dpm := regexp.MustCompile(`^[\s]+Depth Mean$`)
-			tbs := regexp.MustCompile(`^[\s]+Total backfilled jobs \(since last slurm start\)`)
-			tbc := regexp.MustCompile(`^[\s]+Total backfilled jobs \(since last stats cycle start\)`)
-			tbh := regexp.MustCompile(`^[\s]+Total backfilled heterogeneous job components`)
-			switch {
-			case st.MatchString(state):
-				sm.threads, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-			case qs.MatchString(state):
-				sm.queue_size, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-			case dbd.MatchString(state):
-				sm.dbd_queue_size, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-			case lc.MatchString(state):
-				if lc_count == 0 {
-					sm.last_cycle, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-					lc_count = 1
-				}
-				if lc_count == 1 {
-					sm.backfill_last_cycle, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-				}
-			case mc.MatchString(state):
-				if mc_count == 0 {
-					sm.mean_cycle, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-					mc_count = 1
-				}
-				if mc_count == 1 {
-					sm.backfill_mean_cycle, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-				}
-			case cpm.MatchString(state):
-				sm.cycle_per_minute, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-			case dpm.MatchString(state):
-				sm.backfill_depth_mean, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-			case tbs.MatchString(state):
-				sm.total_backfilled_jobs_since_start, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-			case tbc.MatchString(state):
-				sm.total_backfilled_jobs_since_cycle, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-			case tbh.MatchString(state):
-				sm.total_backfilled_heterogeneous, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-			}
+		switch {
+		case strings.HasPrefix(line, "Data since"):
+			sm.stats_since = ParseSdiagTime(strings.TrimPrefix(line, "Data since"))
+			continue
+		case strings.HasPrefix(line, "Main schedule statistics"):
+			section = "main"
+			continue
+		case strings.HasPrefix(line, "Backfilling stats"):
+			section = "backfill"
+			continue
+		case strings.HasPrefix(line, "Latency for") || strings.Contains(line, "Remote Procedure Call") || strings.HasPrefix(line, "Pending RPC"):
+			section = ""
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(kv[0])
+		if section == "backfill" && key == "Last cycle when" {
+			sm.backfill_last_cycle_when = ParseSdiagTime(kv[1])
+		} else if field, ok := sections[section][key]; ok {
+			*field, _ = strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
 		}
 	}
-	rpc_stats := ParseRpcStats(lines)
-	sm.rpc_stats_count = rpc_stats[0]
-	sm.rpc_stats_avg_time = rpc_stats[1]
-	sm.rpc_stats_total_time = rpc_stats[2]
-	sm.user_rpc_stats_count = rpc_stats[3]
-	sm.user_rpc_stats_avg_time = rpc_stats[4]
-	sm.user_rpc_stats_total_time = rpc_stats[5]
+	ParseRpcStats(&sm, lines)
 	return &sm
 }
 
+// ParseSdiagTime converts a date printed by sdiag like 'Wed Apr 12 02:00:00
+// 2017', optionally followed by the Unix time in brackets, to Unix time.
+// Zero if the date can not be parsed.
+func ParseSdiagTime(s string) float64 {
+	fields := strings.Fields(s)
+	if len(fields) == 6 {
+		if unix, err := strconv.ParseFloat(strings.Trim(fields[5], "()"), 64); err == nil {
+			return unix
+		}
+	}
+	if len(fields) < 5 {
+		return 0
+	}
+	t, err := time.ParseInLocation("Mon Jan 2 15:04:05 2006", strings.Join(fields[:5], " "), time.Local)
+	if err != nil {
+		return 0
+	}
+	return float64(t.Unix())
+}
+
 // Helper function to split a single line from the sdiag output
 func SplitColonValueToFloat(input string) float64 {
 	str := strings.Split(input, ":")
@@ -152,68 +200,180 @@ func SplitColonValueToFloat(input string) float64 {
 	}
 }
 
-// Helper function to return RPC stats from sdiag output
-func ParseRpcStats(lines []string) []map[string]float64 {
-	var in_rpc bool
-	var in_rpc_per_user bool
-	var count_stats map[string]float64
-	var avg_stats map[string]float64
-	var total_stats map[string]float64
-	var user_count_stats map[string]float64
-	var user_avg_stats map[string]float64
-	var user_total_stats map[string]float64
-
-	count_stats = make(map[string]float64)
-	avg_stats = make(map[string]float64)
-	total_stats = make(map[string]float64)
-	user_count_stats = make(map[string]float64)
-	user_avg_stats = make(map[string]float64)
-	user_total_stats = make(map[string]float64)
+// Helper function to read the RPC stats from the sdiag output, the message
+// types and users are followed by their id in brackets, e.g.
+//
+//	REQUEST_JOB_INFO                        ( 2003) count:1204   ave_time:130    total_time:156520
+//	root            (       0) count:45219  ave_time:256    total_time:11576064
+//
+// and the pending RPCs have a count only. Slurm has no statistics of the
+// RPCs by user and message type together.
+func ParseRpcStats(sm *SchedulerMetrics, lines []string) {
+	sm.rpc_stats_count = make(map[string]float64)
+	sm.rpc_stats_avg_time = make(map[string]float64)
+	sm.rpc_stats_total_time = make(map[string]float64)
+	sm.rpc_type_ids = make(map[string]string)
+	sm.rpc_pending = make(map[string]float64)
+	sm.user_rpc_stats_count = make(map[string]float64)
+	sm.user_rpc_stats_avg_time = make(map[string]float64)
+	sm.user_rpc_stats_total_time = make(map[string]float64)
+	sm.user_rpc_ids = make(map[string]string)
 
-	in_rpc = false
-	in_rpc_per_user = false
-
-	stat_line_re := regexp.MustCompile(`^\s*([A-Za-z0-9_]*).*count:([0-9]*)\s*ave_time:([0-9]*)\s\s*total_time:([0-9]*)\s*$`)
+	stat_line_re := regexp.MustCompile(`^\s*(\S+)\s*(?:\(\s*([0-9]+)\))?\s*count:([0-9]+)(?:\s+ave_time:([0-9]+)\s+total_time:([0-9]+))?`)
 
+	block := ""
 	for _, line := range lines {
-		if strings.Contains(line, "Remote Procedure Call statistics by message type") {
-			in_rpc = true
-			in_rpc_per_user = false
-		} else if strings.Contains(line, "Remote Procedure Call statistics by user") {
-			in_rpc = false
-			in_rpc_per_user = true
+		switch strings.TrimSpace(line) {
+		case "Remote Procedure Call statistics by message type":
+			block = "type"
+			continue
+		case "Remote Procedure Call statistics by user":
+			block = "user"
+			continue
+		case "Pending RPC statistics":
+			block = "pending"
+			continue
+		case "Pending RPCs":
+			block = ""
+			continue
+		}
+		re_match := stat_line_re.FindStringSubmatch(line)
+		if block == "" || re_match == nil {
+			continue
 		}
-		if in_rpc || in_rpc_per_user {
-			re_match := stat_line_re.FindAllStringSubmatch(line, -1)
-			if re_match != nil {
-				re_match_first := re_match[0]
-				if in_rpc {
-					count_stats[re_match_first[1]], _ = strconv.ParseFloat(re_match_first[2], 64)
-					avg_stats[re_match_first[1]], _ = strconv.ParseFloat(re_match_first[3], 64)
-					total_stats[re_match_first[1]], _ = strconv.ParseFloat(re_match_first[4], 64)
-				} else if in_rpc_per_user {
-					user_count_stats[re_match_first[1]], _ = strconv.ParseFloat(re_match_first[2], 64)
-					user_avg_stats[re_match_first[1]], _ = strconv.ParseFloat(re_match_first[3], 64)
-					user_total_stats[re_match_first[1]], _ = strconv.ParseFloat(re_match_first[4], 64)
-				}
-			}
+		name, id := re_match[1], re_match[2]
+		count, _ := strconv.ParseFloat(re_match[3], 64)
+		avg, _ := strconv.ParseFloat(re_match[4], 64)
+		total, _ := strconv.ParseFloat(re_match[5], 64)
+		switch block {
+		case "type":
+			sm.rpc_stats_count[name] = count
+			sm.rpc_stats_avg_time[name] = avg
+			sm.rpc_stats_total_time[name] = total
+			sm.rpc_type_ids[name] = id
+		case "user":
+			sm.user_rpc_stats_count[name] = count
+			sm.user_rpc_stats_avg_time[name] = avg
+			sm.user_rpc_stats_total_time[name] = total
+			sm.user_rpc_ids[name] = id
+		case "pending":
+			sm.rpc_pending[name] = count
+			sm.rpc_type_ids[name] = id
 		}
 	}
+}
 
-	rpc_stats_final := []map[string]float64{
-		count_stats,
-		avg_stats,
-		total_stats,
-		user_count_stats,
-		user_avg_stats,
-		user_total_stats,
+// TopRpcUsers returns the users with the most RPCs, all users if the limit
+// is 0
+func TopRpcUsers(counts map[string]float64, limit int) []string {
+	users := make([]string, 0, len(counts))
+	for user := range counts {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if counts[users[i]] != counts[users[j]] {
+			return counts[users[i]] > counts[users[j]]
+		}
+		return users[i] < users[j]
+	})
+	if limit > 0 && len(users) > limit {
+		users = users[:limit]
 	}
-	return rpc_stats_final
+	return users
 }
 
 // Returns the scheduler metrics
-func SchedulerGetMetrics() *SchedulerMetrics {
-	return ParseSchedulerMetrics(SchedulerData())
+func SchedulerGetMetrics(runner Runner) (*SchedulerMetrics, error) {
+	data, err := SchedulerData(runner)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSchedulerMetrics(data), nil
+}
+
+// sdiagCounters turns the statistics of sdiag, starting over from zero when
+// they are reset, into counters increasing across the resets
+type sdiagCounters struct {
+	since    float64
+	previous map[string]float64
+	totals   map[string]float64
+}
+
+// Add the increase of every value since the previous snapshot. A value lower
+// than before or a new start of the statistics counts from zero again, the
+// first snapshot is taken as is. Values missing from the snapshot, e.g. of
+// users gone after sdiag -r, are dropped.
+func (c *sdiagCounters) update(since float64, values map[string]float64) map[string]float64 {
+	if c.totals == nil {
+		c.totals = make(map[string]float64)
+	}
+	for key, value := range values {
+		previous, ok := c.previous[key]
+		switch {
+		case !ok || value < previous || since != c.since:
+			c.totals[key] += value
+		default:
+			c.totals[key] += value - previous
+		}
+	}
+	for key := range c.totals {
+		if _, ok := values[key]; !ok {
+			delete(c.totals, key)
+		}
+	}
+	c.since = since
+	c.previous = values
+	return c.totals
+}
+
+// Copy of the counters, updated independently of the original
+func (c *sdiagCounters) clone() sdiagCounters {
+	clone := sdiagCounters{since: c.since}
+	if c.previous != nil {
+		clone.previous = make(map[string]float64, len(c.previous))
+		for key, value := range c.previous {
+			clone.previous[key] = value
+		}
+	}
+	if c.totals != nil {
+		clone.totals = make(map[string]float64, len(c.totals))
+		for key, value := range c.totals {
+			clone.totals[key] = value
+		}
+	}
+	return clone
+}
+
+// Statistics of sdiag reset at midnight and by sdiag -r
+func sdiagStatsCounters(sm *SchedulerMetrics) map[string]float64 {
+	return map[string]float64{
+		"jobs_submitted":                    sm.jobs_submitted,
+		"jobs_started":                      sm.jobs_started,
+		"jobs_completed":                    sm.jobs_completed,
+		"jobs_canceled":                     sm.jobs_canceled,
+		"jobs_failed":                       sm.jobs_failed,
+		"total_cycles":                      sm.total_cycles,
+		"backfill_total_cycles":             sm.backfill_total_cycles,
+		"total_backfilled_jobs_since_cycle": sm.total_backfilled_jobs_since_cycle,
+		"total_backfilled_heterogeneous":    sm.total_backfilled_heterogeneous,
+	}
+}
+
+// Statistics of sdiag only reset by sdiag -r or a restart of slurmctld, the
+// RPC times in seconds
+func sdiagCounts(sm *SchedulerMetrics) map[string]float64 {
+	counts := map[string]float64{
+		"total_backfilled_jobs_since_start": sm.total_backfilled_jobs_since_start,
+	}
+	for rpc_type, value := range sm.rpc_stats_count {
+		counts["rpc_count\xff"+rpc_type] = value
+		counts["rpc_time\xff"+rpc_type] = sm.rpc_stats_total_time[rpc_type] / 1e6
+	}
+	for user, value := range sm.user_rpc_stats_count {
+		counts["user_rpc_count\xff"+user] = value
+		counts["user_rpc_time\xff"+user] = sm.user_rpc_stats_total_time[user] / 1e6
+	}
+	return counts
 }
 
 /*
@@ -224,63 +384,184 @@ func SchedulerGetMetrics() *SchedulerMetrics {
 
 // Collector strcture
 type SchedulerCollector struct {
+	slurm *Slurm
+	// Number of users exposed with their RPC stats, those with the most RPCs
+	UserLimit int
+	// Counters kept by the exporter across the resets of sdiag
+	mu                                sync.Mutex
+	stats                             sdiagCounters
+	counts                            sdiagCounters
 	threads                           *prometheus.Desc
 	queue_size                        *prometheus.Desc
+	agent_count                       *prometheus.Desc
+	agent_thread_count                *prometheus.Desc
 	dbd_queue_size                    *prometheus.Desc
+	jobs_submitted                    *prometheus.Desc
+	jobs_started                      *prometheus.Desc
+	jobs_completed                    *prometheus.Desc
+	jobs_canceled                     *prometheus.Desc
+	jobs_failed                       *prometheus.Desc
+	jobs_pending                      *prometheus.Desc
+	jobs_running                      *prometheus.Desc
 	last_cycle                        *prometheus.Desc
+	max_cycle                         *prometheus.Desc
+	total_cycles                      *prometheus.Desc
 	mean_cycle                        *prometheus.Desc
+	mean_depth_cycle                  *prometheus.Desc
 	cycle_per_minute                  *prometheus.Desc
+	last_queue_length                 *prometheus.Desc
+	backfill_total_cycles             *prometheus.Desc
+	backfill_last_cycle_when          *prometheus.Desc
 	backfill_last_cycle               *prometheus.Desc
+	backfill_max_cycle                *prometheus.Desc
 	backfill_mean_cycle               *prometheus.Desc
+	backfill_last_depth_cycle         *prometheus.Desc
+	backfill_last_depth_cycle_try     *prometheus.Desc
 	backfill_depth_mean               *prometheus.Desc
+	backfill_depth_mean_try           *prometheus.Desc
+	backfill_last_queue_length        *prometheus.Desc
+	backfill_queue_length_mean        *prometheus.Desc
+	backfill_last_table_size          *prometheus.Desc
+	backfill_mean_table_size          *prometheus.Desc
 	total_backfilled_jobs_since_start *prometheus.Desc
 	total_backfilled_jobs_since_cycle *prometheus.Desc
 	total_backfilled_heterogeneous    *prometheus.Desc
+	stats_since                       *prometheus.Desc
 	rpc_stats_count                   *prometheus.Desc
 	rpc_stats_avg_time                *prometheus.Desc
 	rpc_stats_total_time              *prometheus.Desc
 	user_rpc_stats_count              *prometheus.Desc
 	user_rpc_stats_avg_time           *prometheus.Desc
 	user_rpc_stats_total_time         *prometheus.Desc
+	rpc_requests                      *prometheus.Desc
+	rpc_time                          *prometheus.Desc
+	rpc_pending                       *prometheus.Desc
+	user_rpc_requests                 *prometheus.Desc
+	user_rpc_time                     *prometheus.Desc
+	user_rpc_omitted                  *prometheus.Desc
+}
+
+func (sc *SchedulerCollector) configure(config *Config) {
+	sc.UserLimit = config.Scheduler.RPCUserLimit
+}
+
+// Keep the counters increasing across a reload
+func (sc *SchedulerCollector) seed(other Collector) {
+	previous, ok := other.(*SchedulerCollector)
+	if !ok {
+		return
+	}
+	previous.mu.Lock()
+	stats, counts := previous.stats.clone(), previous.counts.clone()
+	previous.mu.Unlock()
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.stats = stats
+	sc.counts = counts
 }
 
 // Send all metric descriptions
 func (c *SchedulerCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.threads
 	ch <- c.queue_size
+	ch <- c.agent_count
+	ch <- c.agent_thread_count
 	ch <- c.dbd_queue_size
+	ch <- c.jobs_submitted
+	ch <- c.jobs_started
+	ch <- c.jobs_completed
+	ch <- c.jobs_canceled
+	ch <- c.jobs_failed
+	ch <- c.jobs_pending
+	ch <- c.jobs_running
 	ch <- c.last_cycle
+	ch <- c.max_cycle
+	ch <- c.total_cycles
 	ch <- c.mean_cycle
+	ch <- c.mean_depth_cycle
 	ch <- c.cycle_per_minute
+	ch <- c.last_queue_length
+	ch <- c.backfill_total_cycles
+	ch <- c.backfill_last_cycle_when
 	ch <- c.backfill_last_cycle
+	ch <- c.backfill_max_cycle
 	ch <- c.backfill_mean_cycle
+	ch <- c.backfill_last_depth_cycle
+	ch <- c.backfill_last_depth_cycle_try
 	ch <- c.backfill_depth_mean
+	ch <- c.backfill_depth_mean_try
+	ch <- c.backfill_last_queue_length
+	ch <- c.backfill_queue_length_mean
+	ch <- c.backfill_last_table_size
+	ch <- c.backfill_mean_table_size
 	ch <- c.total_backfilled_jobs_since_start
 	ch <- c.total_backfilled_jobs_since_cycle
 	ch <- c.total_backfilled_heterogeneous
+	ch <- c.stats_since
 	ch <- c.rpc_stats_count
 	ch <- c.rpc_stats_avg_time
 	ch <- c.rpc_stats_total_time
 	ch <- c.user_rpc_stats_count
 	ch <- c.user_rpc_stats_avg_time
 	ch <- c.user_rpc_stats_total_time
+	ch <- c.rpc_requests
+	ch <- c.rpc_time
+	ch <- c.rpc_pending
+	ch <- c.user_rpc_requests
+	ch <- c.user_rpc_time
+	ch <- c.user_rpc_omitted
 }
 
 // Send the values of all metrics
-func (sc *SchedulerCollector) Collect(ch chan<- prometheus.Metric) {
-	sm := SchedulerGetMetrics()
+func (sc *SchedulerCollector) Update(ch chan<- prometheus.Metric) error {
+	sm, err := sc.slurm.Diag()
+	if err != nil {
+		return err
+	}
+	sc.mu.Lock()
+	stats := sc.stats.update(sm.stats_since, sdiagStatsCounters(sm))
+	counts := sc.counts.update(0, sdiagCounts(sm))
+	sc.mu.Unlock()
 	ch <- prometheus.MustNewConstMetric(sc.threads, prometheus.GaugeValue, sm.threads)
 	ch <- prometheus.MustNewConstMetric(sc.queue_size, prometheus.GaugeValue, sm.queue_size)
+	ch <- prometheus.MustNewConstMetric(sc.agent_count, prometheus.GaugeValue, sm.agent_count)
+	ch <- prometheus.MustNewConstMetric(sc.agent_thread_count, prometheus.GaugeValue, sm.agent_thread_count)
 	ch <- prometheus.MustNewConstMetric(sc.dbd_queue_size, prometheus.GaugeValue, sm.dbd_queue_size)
+	ch <- prometheus.MustNewConstMetric(sc.jobs_submitted, prometheus.CounterValue, stats["jobs_submitted"])
+	ch <- prometheus.MustNewConstMetric(sc.jobs_started, prometheus.CounterValue, stats["jobs_started"])
+	ch <- prometheus.MustNewConstMetric(sc.jobs_completed, prometheus.CounterValue, stats["jobs_completed"])
+	ch <- prometheus.MustNewConstMetric(sc.jobs_canceled, prometheus.CounterValue, stats["jobs_canceled"])
+	ch <- prometheus.MustNewConstMetric(sc.jobs_failed, prometheus.CounterValue, stats["jobs_failed"])
+	ch <- prometheus.MustNewConstMetric(sc.jobs_pending, prometheus.GaugeValue, sm.jobs_pending)
+	ch <- prometheus.MustNewConstMetric(sc.jobs_running, prometheus.GaugeValue, sm.jobs_running)
 	ch <- prometheus.MustNewConstMetric(sc.last_cycle, prometheus.GaugeValue, sm.last_cycle)
+	ch <- prometheus.MustNewConstMetric(sc.max_cycle, prometheus.GaugeValue, sm.max_cycle)
+	ch <- prometheus.MustNewConstMetric(sc.total_cycles, prometheus.CounterValue, stats["total_cycles"])
 	ch <- prometheus.MustNewConstMetric(sc.mean_cycle, prometheus.GaugeValue, sm.mean_cycle)
+	ch <- prometheus.MustNewConstMetric(sc.mean_depth_cycle, prometheus.GaugeValue, sm.mean_depth_cycle)
 	ch <- prometheus.MustNewConstMetric(sc.cycle_per_minute, prometheus.GaugeValue, sm.cycle_per_minute)
+	ch <- prometheus.MustNewConstMetric(sc.last_queue_length, prometheus.GaugeValue, sm.last_queue_length)
+	ch <- prometheus.MustNewConstMetric(sc.backfill_total_cycles, prometheus.CounterValue, stats["backfill_total_cycles"])
+	if sm.backfill_last_cycle_when > 0 {
+		ch <- prometheus.MustNewConstMetric(sc.backfill_last_cycle_when, prometheus.GaugeValue, sm.backfill_last_cycle_when)
+	}
 	ch <- prometheus.MustNewConstMetric(sc.backfill_last_cycle, prometheus.GaugeValue, sm.backfill_last_cycle)
+	ch <- prometheus.MustNewConstMetric(sc.backfill_max_cycle, prometheus.GaugeValue, sm.backfill_max_cycle)
 	ch <- prometheus.MustNewConstMetric(sc.backfill_mean_cycle, prometheus.GaugeValue, sm.backfill_mean_cycle)
+	ch <- prometheus.MustNewConstMetric(sc.backfill_last_depth_cycle, prometheus.GaugeValue, sm.backfill_last_depth_cycle)
+	ch <- prometheus.MustNewConstMetric(sc.backfill_last_depth_cycle_try, prometheus.GaugeValue, sm.backfill_last_depth_cycle_try)
 	ch <- prometheus.MustNewConstMetric(sc.backfill_depth_mean, prometheus.GaugeValue, sm.backfill_depth_mean)
-	ch <- prometheus.MustNewConstMetric(sc.total_backfilled_jobs_since_start, prometheus.GaugeValue, sm.total_backfilled_jobs_since_start)
-	ch <- prometheus.MustNewConstMetric(sc.total_backfilled_jobs_since_cycle, prometheus.GaugeValue, sm.total_backfilled_jobs_since_cycle)
-	ch <- prometheus.MustNewConstMetric(sc.total_backfilled_heterogeneous, prometheus.GaugeValue, sm.total_backfilled_heterogeneous)
+	ch <- prometheus.MustNewConstMetric(sc.backfill_depth_mean_try, prometheus.GaugeValue, sm.backfill_depth_mean_try)
+	ch <- prometheus.MustNewConstMetric(sc.backfill_last_queue_length, prometheus.GaugeValue, sm.backfill_last_queue_length)
+	ch <- prometheus.MustNewConstMetric(sc.backfill_queue_length_mean, prometheus.GaugeValue, sm.backfill_queue_length_mean)
+	ch <- prometheus.MustNewConstMetric(sc.backfill_last_table_size, prometheus.GaugeValue, sm.backfill_last_table_size)
+	ch <- prometheus.MustNewConstMetric(sc.backfill_mean_table_size, prometheus.GaugeValue, sm.backfill_mean_table_size)
+	ch <- prometheus.MustNewConstMetric(sc.total_backfilled_jobs_since_start, prometheus.CounterValue, counts["total_backfilled_jobs_since_start"])
+	ch <- prometheus.MustNewConstMetric(sc.total_backfilled_jobs_since_cycle, prometheus.CounterValue, stats["total_backfilled_jobs_since_cycle"])
+	ch <- prometheus.MustNewConstMetric(sc.total_backfilled_heterogeneous, prometheus.CounterValue, stats["total_backfilled_heterogeneous"])
+	if sm.stats_since > 0 {
+		ch <- prometheus.MustNewConstMetric(sc.stats_since, prometheus.GaugeValue, sm.stats_since)
+	}
 	for rpc_type, value := range sm.rpc_stats_count {
 		ch <- prometheus.MustNewConstMetric(sc.rpc_stats_count, prometheus.GaugeValue, value, rpc_type)
 	}
@@ -290,25 +571,37 @@ func (sc *SchedulerCollector) Collect(ch chan<- prometheus.Metric) {
 	for rpc_type, value := range sm.rpc_stats_total_time {
 		ch <- prometheus.MustNewConstMetric(sc.rpc_stats_total_time, prometheus.GaugeValue, value, rpc_type)
 	}
-	for user, value := range sm.user_rpc_stats_count {
-		ch <- prometheus.MustNewConstMetric(sc.user_rpc_stats_count, prometheus.GaugeValue, value, user)
+	for rpc_type := range sm.rpc_stats_count {
+		ch <- prometheus.MustNewConstMetric(sc.rpc_requests, prometheus.CounterValue, counts["rpc_count\xff"+rpc_type], rpc_type, sm.rpc_type_ids[rpc_type])
+		ch <- prometheus.MustNewConstMetric(sc.rpc_time, prometheus.CounterValue, counts["rpc_time\xff"+rpc_type], rpc_type, sm.rpc_type_ids[rpc_type])
 	}
-	for user, value := range sm.user_rpc_stats_avg_time {
-		ch <- prometheus.MustNewConstMetric(sc.user_rpc_stats_avg_time, prometheus.GaugeValue, value, user)
+	for rpc_type, value := range sm.rpc_pending {
+		ch <- prometheus.MustNewConstMetric(sc.rpc_pending, prometheus.GaugeValue, value, rpc_type, sm.rpc_type_ids[rpc_type])
 	}
-	for user, value := range sm.user_rpc_stats_total_time {
-		ch <- prometheus.MustNewConstMetric(sc.user_rpc_stats_total_time, prometheus.GaugeValue, value, user)
+	users := TopRpcUsers(sm.user_rpc_stats_count, sc.UserLimit)
+	for _, user := range users {
+		ch <- prometheus.MustNewConstMetric(sc.user_rpc_stats_count, prometheus.GaugeValue, sm.user_rpc_stats_count[user], user)
+		ch <- prometheus.MustNewConstMetric(sc.user_rpc_stats_avg_time, prometheus.GaugeValue, sm.user_rpc_stats_avg_time[user], user)
+		ch <- prometheus.MustNewConstMetric(sc.user_rpc_stats_total_time, prometheus.GaugeValue, sm.user_rpc_stats_total_time[user], user)
+		ch <- prometheus.MustNewConstMetric(sc.user_rpc_requests, prometheus.CounterValue, counts["user_rpc_count\xff"+user], user, sm.user_rpc_ids[user])
+		ch <- prometheus.MustNewConstMetric(sc.user_rpc_time, prometheus.CounterValue, counts["user_rpc_time\xff"+user], user, sm.user_rpc_ids[user])
 	}
-
+	ch <- prometheus.MustNewConstMetric(sc.user_rpc_omitted, prometheus.GaugeValue, float64(len(sm.user_rpc_stats_count)-len(users)))
+	return nil
 }
 
 // Returns the Slurm scheduler collector, used to register with the prometheus client
-func NewSchedulerCollector() *SchedulerCollector {
+func NewSchedulerCollector(slurm *Slurm) *SchedulerCollector {
 	rpc_stats_labels := make([]string, 0, 1)
 	rpc_stats_labels = append(rpc_stats_labels, "operation")
 	user_rpc_stats_labels := make([]string, 0, 1)
 	user_rpc_stats_labels = append(user_rpc_stats_labels, "user")
+	// The counters kept by the exporter and the pending RPCs are labeled with
+	// the ids of the message types and users in addition
+	rpc_type_labels := []string{"operation", "type_id"}
+	rpc_user_labels := []string{"user", "user_id"}
 	return &SchedulerCollector{
+		slurm: slurm,
 		threads: prometheus.NewDesc(
 			"slurm_scheduler_threads",
 			"Information provided by the Slurm sdiag command, number of scheduler threads ",
@@ -319,41 +612,156 @@ func NewSchedulerCollector() *SchedulerCollector {
 			"Information provided by the Slurm sdiag command, length of the scheduler queue",
 			nil,
 			nil),
+		agent_count: prometheus.NewDesc(
+			"slurm_scheduler_agent_count",
+			"Information provided by the Slurm sdiag command, number of agent threads",
+			nil,
+			nil),
+		agent_thread_count: prometheus.NewDesc(
+			"slurm_scheduler_agent_thread_count",
+			"Information provided by the Slurm sdiag command, total number of active threads created by all agent threads",
+			nil,
+			nil),
 		dbd_queue_size: prometheus.NewDesc(
 			"slurm_scheduler_dbd_queue_size",
 			"Information provided by the Slurm sdiag command, length of the DBD agent queue",
 			nil,
 			nil),
+		jobs_submitted: prometheus.NewDesc(
+			"slurm_scheduler_jobs_submitted_total",
+			"Information provided by the Slurm sdiag command, number of jobs submitted, kept increasing across the resets of the statistics",
+			nil,
+			nil),
+		jobs_started: prometheus.NewDesc(
+			"slurm_scheduler_jobs_started_total",
+			"Information provided by the Slurm sdiag command, number of jobs started, kept increasing across the resets of the statistics",
+			nil,
+			nil),
+		jobs_completed: prometheus.NewDesc(
+			"slurm_scheduler_jobs_completed_total",
+			"Information provided by the Slurm sdiag command, number of jobs completed, kept increasing across the resets of the statistics",
+			nil,
+			nil),
+		jobs_canceled: prometheus.NewDesc(
+			"slurm_scheduler_jobs_canceled_total",
+			"Information provided by the Slurm sdiag command, number of jobs canceled, kept increasing across the resets of the statistics",
+			nil,
+			nil),
+		jobs_failed: prometheus.NewDesc(
+			"slurm_scheduler_jobs_failed_total",
+			"Information provided by the Slurm sdiag command, number of jobs failed, kept increasing across the resets of the statistics",
+			nil,
+			nil),
+		jobs_pending: prometheus.NewDesc(
+			"slurm_scheduler_jobs_pending",
+			"Information provided by the Slurm sdiag command, number of pending jobs when the statistics were taken",
+			nil,
+			nil),
+		jobs_running: prometheus.NewDesc(
+			"slurm_scheduler_jobs_running",
+			"Information provided by the Slurm sdiag command, number of running jobs when the statistics were taken",
+			nil,
+			nil),
 		last_cycle: prometheus.NewDesc(
 			"slurm_scheduler_last_cycle",
 			"Information provided by the Slurm sdiag command, scheduler last cycle time in (microseconds)",
 			nil,
 			nil),
+		max_cycle: prometheus.NewDesc(
+			"slurm_scheduler_max_cycle",
+			"Information provided by the Slurm sdiag command, scheduler max cycle time in (microseconds)",
+			nil,
+			nil),
+		total_cycles: prometheus.NewDesc(
+			"slurm_scheduler_cycles_total",
+			"Information provided by the Slurm sdiag command, number of scheduler cycles, kept increasing across the resets of the statistics",
+			nil,
+			nil),
 		mean_cycle: prometheus.NewDesc(
 			"slurm_scheduler_mean_cycle",
 			"Information provided by the Slurm sdiag command, scheduler mean cycle time in (microseconds)",
 			nil,
 			nil),
+		mean_depth_cycle: prometheus.NewDesc(
+			"slurm_scheduler_mean_depth_cycle",
+			"Information provided by the Slurm sdiag command, scheduler mean number of jobs processed per cycle",
+			nil,
+			nil),
 		cycle_per_minute: prometheus.NewDesc(
 			"slurm_scheduler_cycle_per_minute",
 			"Information provided by the Slurm sdiag command, number scheduler cycles per minute",
 			nil,
 			nil),
+		last_queue_length: prometheus.NewDesc(
+			"slurm_scheduler_last_queue_length",
+			"Information provided by the Slurm sdiag command, length of the queue processed by the last scheduler cycle",
+			nil,
+			nil),
+		backfill_total_cycles: prometheus.NewDesc(
+			"slurm_scheduler_backfill_cycles_total",
+			"Information provided by the Slurm sdiag command, number of backfill cycles, kept increasing across the resets of the statistics",
+			nil,
+			nil),
+		backfill_last_cycle_when: prometheus.NewDesc(
+			"slurm_scheduler_backfill_last_cycle_timestamp_seconds",
+			"Information provided by the Slurm sdiag command, time of the last backfill cycle as Unix time",
+			nil,
+			nil),
 		backfill_last_cycle: prometheus.NewDesc(
 			"slurm_scheduler_backfill_last_cycle",
 			"Information provided by the Slurm sdiag command, scheduler backfill last cycle time in (microseconds)",
 			nil,
 			nil),
+		backfill_max_cycle: prometheus.NewDesc(
+			"slurm_scheduler_backfill_max_cycle",
+			"Information provided by the Slurm sdiag command, scheduler backfill max cycle time in (microseconds)",
+			nil,
+			nil),
 		backfill_mean_cycle: prometheus.NewDesc(
 			"slurm_scheduler_backfill_mean_cycle",
 			"Information provided by the Slurm sdiag command, scheduler backfill mean cycle time in (microseconds)",
 			nil,
 			nil),
+		backfill_last_depth_cycle: prometheus.NewDesc(
+			"slurm_scheduler_backfill_last_depth_cycle",
+			"Information provided by the Slurm sdiag command, number of jobs processed by the last backfill cycle",
+			nil,
+			nil),
+		backfill_last_depth_cycle_try: prometheus.NewDesc(
+			"slurm_scheduler_backfill_last_depth_cycle_try_sched",
+			"Information provided by the Slurm sdiag command, number of jobs tried to schedule by the last backfill cycle",
+			nil,
+			nil),
 		backfill_depth_mean: prometheus.NewDesc(
 			"slurm_scheduler_backfill_depth_mean",
 			"Information provided by the Slurm sdiag command, scheduler backfill mean depth",
 			nil,
 			nil),
+		backfill_depth_mean_try: prometheus.NewDesc(
+			"slurm_scheduler_backfill_depth_mean_try_sched",
+			"Information provided by the Slurm sdiag command, scheduler backfill mean number of jobs tried to schedule",
+			nil,
+			nil),
+		backfill_last_queue_length: prometheus.NewDesc(
+			"slurm_scheduler_backfill_last_queue_length",
+			"Information provided by the Slurm sdiag command, length of the queue processed by the last backfill cycle",
+			nil,
+			nil),
+		backfill_queue_length_mean: prometheus.NewDesc(
+			"slurm_scheduler_backfill_queue_length_mean",
+			"Information provided by the Slurm sdiag command, scheduler backfill mean queue length",
+			nil,
+			nil),
+		backfill_last_table_size: prometheus.NewDesc(
+			"slurm_scheduler_backfill_last_table_size",
+			"Information provided by the Slurm sdiag command, number of time slots in the last backfill cycle",
+			nil,
+			nil),
+		backfill_mean_table_size: prometheus.NewDesc(
+			"slurm_scheduler_backfill_mean_table_size",
+			"Information provided by the Slurm sdiag command, scheduler backfill mean number of time slots",
+			nil,
+			nil),
 		total_backfilled_jobs_since_start: prometheus.NewDesc(
 			"slurm_scheduler_backfilled_jobs_since_start_total",
 			"Information provided by the Slurm sdiag command, number of jobs started thanks to backfilling since last slurm start",
@@ -369,6 +777,11 @@ func NewSchedulerCollector() *SchedulerCollector {
 			"Information provided by the Slurm sdiag command, number of heterogeneous job components started thanks to backfilling since last Slurm start",
 			nil,
 			nil),
+		stats_since: prometheus.NewDesc(
+			"slurm_scheduler_stats_since_timestamp_seconds",
+			"Information provided by the Slurm sdiag command, start of the statistics as Unix time, reset at midnight and by sdiag -r",
+			nil,
+			nil),
 		rpc_stats_count: prometheus.NewDesc(
 			"slurm_rpc_stats",
 			"Information provided by the Slurm sdiag command, rpc count statistic",
@@ -399,5 +812,35 @@ func NewSchedulerCollector() *SchedulerCollector {
 			"Information provided by the Slurm sdiag command, rpc total time statistic per user",
 			user_rpc_stats_labels,
 			nil),
+		rpc_requests: prometheus.NewDesc(
+			"slurm_rpc_requests_total",
+			"Information provided by the Slurm sdiag command, number of rpcs, kept increasing across the resets of the statistics",
+			rpc_type_labels,
+			nil),
+		rpc_time: prometheus.NewDesc(
+			"slurm_rpc_time_seconds_total",
+			"Information provided by the Slurm sdiag command, time spent on rpcs, kept increasing across the resets of the statistics",
+			rpc_type_labels,
+			nil),
+		rpc_pending: prometheus.NewDesc(
+			"slurm_rpc_pending",
+			"Information provided by the Slurm sdiag command, number of pending rpcs",
+			rpc_type_labels,
+			nil),
+		user_rpc_requests: prometheus.NewDesc(
+			"slurm_user_rpc_requests_total",
+			"Information provided by the Slurm sdiag command, number of rpcs per user, kept increasing across the resets of the statistics",
+			rpc_user_labels,
+			nil),
+		user_rpc_time: prometheus.NewDesc(
+			"slurm_user_rpc_time_seconds_total",
+			"Information provided by the Slurm sdiag command, time spent on rpcs per user, kept increasing across the resets of the statistics",
+			rpc_user_labels,
+			nil),
+		user_rpc_omitted: prometheus.NewDesc(
+			"slurm_user_rpc_omitted",
+			"Users not exposed with their rpc stats because of the user limit of the scheduler collector",
+			nil,
+			nil),
 	}
 }
@@ -16,9 +16,15 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>. */
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestSchedulerMetrics(t *testing.T) {
@@ -30,3 +36,138 @@ func TestSchedulerMetrics(t *testing.T) {
 	data, err := ioutil.ReadAll(file)
 	t.Logf("%+v", ParseSchedulerMetrics(data))
 }
+
+func TestSchedulerMetricsSections(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sdiag.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	sm := ParseSchedulerMetrics(data)
+	// Fields named alike in the main and the backfill sections
+	assert.Equal(t, 97209.0, sm.last_cycle)
+	assert.Equal(t, 1942890.0, sm.backfill_last_cycle)
+	assert.Equal(t, 74593.0, sm.mean_cycle)
+	assert.Equal(t, 1960820.0, sm.backfill_mean_cycle)
+	assert.Equal(t, 34585.0, sm.total_cycles)
+	assert.Equal(t, 529.0, sm.backfill_total_cycles)
+	assert.Equal(t, 57011.0, sm.last_queue_length)
+	assert.Equal(t, 57064.0, sm.backfill_last_queue_length)
+	assert.Equal(t, 29324.0, sm.backfill_depth_mean)
+	assert.Equal(t, 1659.0, sm.backfill_depth_mean_try)
+	assert.Equal(t, 35395.0, sm.jobs_started)
+	assert.Equal(t, float64(time.Date(2017, 4, 12, 2, 0, 0, 0, time.Local).Unix()), sm.stats_since)
+	assert.Equal(t, float64(time.Date(2017, 4, 12, 11, 3, 21, 0, time.Local).Unix()), sm.backfill_last_cycle_when)
+
+	// Newer Slurm versions print the Unix time along with the date
+	assert.Equal(t, 1491955200.0, ParseSdiagTime(" Wed Apr 12 02:00:00 2017 (1491955200)"))
+	assert.Equal(t, 0.0, ParseSdiagTime("N/A"))
+}
+
+func TestSchedulerCollector(t *testing.T) {
+	runner := NewFakeRunner().File(t, "sdiag", "test_data/sdiag.txt")
+	expected := `
+# HELP slurm_scheduler_backfill_max_cycle Information provided by the Slurm sdiag command, scheduler backfill max cycle time in (microseconds)
+# TYPE slurm_scheduler_backfill_max_cycle gauge
+slurm_scheduler_backfill_max_cycle 5.933334e+06
+# HELP slurm_scheduler_cycles_total Information provided by the Slurm sdiag command, number of scheduler cycles, kept increasing across the resets of the statistics
+# TYPE slurm_scheduler_cycles_total counter
+slurm_scheduler_cycles_total 34585
+# HELP slurm_scheduler_jobs_submitted_total Information provided by the Slurm sdiag command, number of jobs submitted, kept increasing across the resets of the statistics
+# TYPE slurm_scheduler_jobs_submitted_total counter
+slurm_scheduler_jobs_submitted_total 9706
+# HELP slurm_scheduler_max_cycle Information provided by the Slurm sdiag command, scheduler max cycle time in (microseconds)
+# TYPE slurm_scheduler_max_cycle gauge
+slurm_scheduler_max_cycle 1.40759e+06
+`
+	exporter := NewSlurmExporter(map[string]Collector{"scheduler": NewSchedulerCollector(NewSlurm(NewCommandSource(runner)))})
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected),
+		"slurm_scheduler_backfill_max_cycle", "slurm_scheduler_cycles_total",
+		"slurm_scheduler_jobs_submitted_total", "slurm_scheduler_max_cycle"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSdiagCounters(t *testing.T) {
+	var c sdiagCounters
+	assert.Equal(t, map[string]float64{"a": 10}, c.update(1, map[string]float64{"a": 10}))
+	assert.Equal(t, map[string]float64{"a": 15}, c.update(1, map[string]float64{"a": 15}))
+	// Reset of the statistics at midnight, the value grew past the previous one
+	assert.Equal(t, map[string]float64{"a": 35}, c.update(2, map[string]float64{"a": 20}))
+	// Reset by sdiag -r, the start of the statistics not yet changed
+	assert.Equal(t, map[string]float64{"a": 38, "b": 1}, c.update(2, map[string]float64{"a": 3, "b": 1}))
+	// Values missing from the snapshot are dropped and count from zero again
+	assert.Equal(t, map[string]float64{"b": 2}, c.update(2, map[string]float64{"b": 2}))
+	assert.Equal(t, map[string]float64{"a": 4, "b": 2}, c.update(2, map[string]float64{"a": 4, "b": 2}))
+}
+
+func TestSchedulerCollectorResets(t *testing.T) {
+	sdiag := func(since string, submitted, count int) []byte {
+		return []byte(fmt.Sprintf(`Data since      %s
+Jobs submitted: %d
+
+Remote Procedure Call statistics by message type
+	REQUEST_JOB_INFO                        ( 2003) count:%d ave_time:1000 total_time:%d
+
+Remote Procedure Call statistics by user
+	root            (       0) count:%d ave_time:1000 total_time:%d
+`, since, submitted, count, count*1000, count, count*1000))
+	}
+	runner := NewFakeRunner()
+	runner.Output["sdiag"] = sdiag("Wed Apr 12 00:00:00 2017", 9706, 500)
+	exporter := NewSlurmExporter(map[string]Collector{"scheduler": NewSchedulerCollector(NewSlurm(NewCommandSource(runner)))})
+	submitted := func(value string) string {
+		return `
+# HELP slurm_scheduler_jobs_submitted_total Information provided by the Slurm sdiag command, number of jobs submitted, kept increasing across the resets of the statistics
+# TYPE slurm_scheduler_jobs_submitted_total counter
+slurm_scheduler_jobs_submitted_total ` + value + "\n"
+	}
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(submitted("9706")), "slurm_scheduler_jobs_submitted_total"); err != nil {
+		t.Error(err)
+	}
+	// Statistics reset at midnight, the RPC statistics only by sdiag -r
+	runner.Output["sdiag"] = sdiag("Thu Apr 13 00:00:00 2017", 12, 600)
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(submitted("9718")), "slurm_scheduler_jobs_submitted_total"); err != nil {
+		t.Error(err)
+	}
+	runner.Output["sdiag"] = sdiag("Thu Apr 13 00:00:00 2017", 20, 50)
+	expected := `
+# HELP slurm_rpc_requests_total Information provided by the Slurm sdiag command, number of rpcs, kept increasing across the resets of the statistics
+# TYPE slurm_rpc_requests_total counter
+slurm_rpc_requests_total{operation="REQUEST_JOB_INFO",type_id="2003"} 650
+# HELP slurm_rpc_stats Information provided by the Slurm sdiag command, rpc count statistic
+# TYPE slurm_rpc_stats gauge
+slurm_rpc_stats{operation="REQUEST_JOB_INFO"} 50
+# HELP slurm_user_rpc_time_seconds_total Information provided by the Slurm sdiag command, time spent on rpcs per user, kept increasing across the resets of the statistics
+# TYPE slurm_user_rpc_time_seconds_total counter
+slurm_user_rpc_time_seconds_total{user="root",user_id="0"} 0.65
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "slurm_rpc_requests_total",
+		"slurm_rpc_stats", "slurm_user_rpc_time_seconds_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSchedulerCollectorRPCs(t *testing.T) {
+	runner := NewFakeRunner().File(t, "sdiag", "test_data/sdiag.txt")
+	collector := NewSchedulerCollector(NewSlurm(NewCommandSource(runner)))
+	collector.UserLimit = 1
+	expected := `
+# HELP slurm_rpc_pending Information provided by the Slurm sdiag command, number of pending rpcs
+# TYPE slurm_rpc_pending gauge
+slurm_rpc_pending{operation="REQUEST_TERMINATE_JOB",type_id="6011"} 3
+# HELP slurm_user_rpc_requests_total Information provided by the Slurm sdiag command, number of rpcs per user, kept increasing across the resets of the statistics
+# TYPE slurm_user_rpc_requests_total counter
+slurm_user_rpc_requests_total{user="root",user_id="0"} 45219
+# HELP slurm_user_rpc_stats Information provided by the Slurm sdiag command, rpc count statistic per user
+# TYPE slurm_user_rpc_stats gauge
+slurm_user_rpc_stats{user="root"} 45219
+# HELP slurm_user_rpc_omitted Users not exposed with their rpc stats because of the user limit of the scheduler collector
+# TYPE slurm_user_rpc_omitted gauge
+slurm_user_rpc_omitted 1
+`
+	exporter := NewSlurmExporter(map[string]Collector{"scheduler": collector})
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "slurm_rpc_pending",
+		"slurm_user_rpc_requests_total", "slurm_user_rpc_stats", "slurm_user_rpc_omitted"); err != nil {
+		t.Error(err)
+	}
+}
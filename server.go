@@ -0,0 +1,230 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/log"
+)
+
+/*
+ * The Server serves the metrics of the clusters and collectors described
+ * by the configuration. On reload the clusters are built from the new
+ * configuration and replace the old ones once complete, scrapes keep being
+ * served by the old ones meanwhile. A configuration which fails to load
+ * leaves the running one in place, the web configuration is only applied
+ * along with the main one.
+ */
+
+type Server struct {
+	defaults   *Config
+	configFile string
+
+	// Web configuration reloaded together with the configuration file
+	Web *WebServer
+
+	// Serializes reloads
+	reload sync.Mutex
+
+	mu       sync.RWMutex
+	clusters []*Cluster
+	handler  http.Handler
+}
+
+func NewServer(defaults *Config, configFile string) (*Server, error) {
+	s := &Server{
+		defaults:   defaults,
+		configFile: configFile,
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload the configuration file and rebuild all clusters and collectors
+func (s *Server) Reload() error {
+	s.reload.Lock()
+	defer s.reload.Unlock()
+
+	// Both configurations are validated before either is applied
+	var webConfig *WebConfig
+	var tlsConfig *tls.Config
+	if s.Web != nil {
+		var err error
+		if webConfig, tlsConfig, err = s.Web.load(); err != nil {
+			return err
+		}
+	}
+	config, err := LoadConfig(s.configFile, s.defaults)
+	if err != nil {
+		return err
+	}
+	clusters, err := newClusters(config)
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	old := s.clusters
+	s.mu.RUnlock()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewGoCollector())
+	registry.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	for _, cluster := range clusters {
+		for _, o := range old {
+			if o.Name == cluster.Name {
+				cluster.Seed(o)
+			}
+		}
+		startPolling(cluster, config, old)
+		if err := cluster.Register(registry); err != nil {
+			stopPolling(clusters)
+			return err
+		}
+		if cluster.Name != "" {
+			log.Infof("Scraping cluster %s", cluster.Name)
+		}
+	}
+	handler := NewMetricsHandler(clusters, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	if s.Web != nil {
+		s.Web.set(webConfig, tlsConfig)
+	}
+	s.mu.Lock()
+	s.clusters = clusters
+	s.handler = handler
+	s.mu.Unlock()
+	stopPolling(old)
+	log.Infof("Enabled collectors: %s", strings.Join(config.EnabledCollectors(), ", "))
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	handler := s.handler
+	s.mu.RUnlock()
+	handler.ServeHTTP(w, r)
+}
+
+// ReloadHandler reloads the configuration on POST requests
+func (s *Server) ReloadHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "reload requires a POST request", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := s.Reload(); err != nil {
+			log.Errorf("Reloading the configuration failed: %v", err)
+			http.Error(w, fmt.Sprintf("failed to reload config: %v", err), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "config reloaded")
+	})
+}
+
+// Build the clusters to scrape and their collectors, each cluster has its
+// own source of Slurm data
+func newClusters(config *Config) ([]*Cluster, error) {
+	names := config.EnabledCollectors()
+	if rest := config.Slurm.Rest; rest.URL != "" {
+		source := NewRestSource(rest.URL)
+		source.Version = rest.APIVersion
+		source.User = rest.User
+		source.TokenFile = rest.TokenFile
+		source.Client.Timeout = config.Slurm.Timeout
+		cluster, err := NewCluster("", source, names)
+		if err != nil {
+			return nil, err
+		}
+		cluster.Configure(config)
+		return []*Cluster{cluster}, nil
+	}
+	execRunner := NewExecRunner()
+	execRunner.BinDir = config.Slurm.BinDir
+	execRunner.Timeout = config.Slurm.Timeout
+	for command, path := range config.Slurm.Paths {
+		execRunner.Paths[command] = path
+	}
+	for command, timeout := range config.Slurm.CommandTimeouts {
+		execRunner.Timeouts[command] = timeout
+	}
+	clusterNames := config.Slurm.Clusters
+	if len(clusterNames) == 0 {
+		clusterNames = []string{""}
+	}
+	var clusters []*Cluster
+	for _, name := range clusterNames {
+		var runner Runner = execRunner
+		if name != "" {
+			runner = &ClusterRunner{Runner: execRunner, Cluster: name}
+		}
+		commands := NewInstrumentedRunner(runner)
+		source := NewCommandSource(commands)
+		if err := source.SetFormat(config.Slurm.OutputFormat); err != nil {
+			return nil, err
+		}
+		cluster, err := NewCluster(name, source, names)
+		if err != nil {
+			return nil, err
+		}
+		cluster.Commands = commands
+		cluster.Configure(config)
+		clusters = append(clusters, cluster)
+	}
+	return clusters, nil
+}
+
+// Refresh the collectors with a poll interval in the background. The
+// metrics of the same collector before the reload are served until the
+// first refresh.
+func startPolling(cluster *Cluster, config *Config, old []*Cluster) {
+	for name, c := range cluster.Collectors {
+		interval, ok := config.Poll.CollectorIntervals[name]
+		if !ok {
+			interval = config.Poll.Interval
+		}
+		if interval <= 0 {
+			continue
+		}
+		log.Infof("Refreshing collector %s every %v", name, interval)
+		cached := NewCachedCollector(name, c, interval)
+		for _, o := range old {
+			if previous, ok := o.Collectors[name].(*CachedCollector); ok && o.Name == cluster.Name {
+				cached.Seed(previous)
+			}
+		}
+		cached.Start()
+		cluster.Collectors[name] = cached
+	}
+}
+
+func stopPolling(clusters []*Cluster) {
+	for _, cluster := range clusters {
+		for _, c := range cluster.Collectors {
+			if cached, ok := c.(*CachedCollector); ok {
+				cached.Stop()
+			}
+		}
+	}
+}
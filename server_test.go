@@ -0,0 +1,143 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func scrape(handler http.Handler, url string) (int, string) {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+	body, _ := ioutil.ReadAll(rec.Body)
+	return rec.Code, string(body)
+}
+
+func TestServerReload(t *testing.T) {
+	defaults := testDefaults()
+	defaults.Slurm.BinDir = t.TempDir()
+	path := writeConfig(t, "collectors:\n  fairshare: false\n")
+	server, err := NewServer(defaults, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, body := scrape(server, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `slurm_exporter_collector_success{collector="cpus"} 0`)
+	assert.NotContains(t, body, `collector="fairshare"`)
+
+	// Reloading requires a POST request
+	rec := httptest.NewRecorder()
+	server.ReloadHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/-/reload", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	ioutil.WriteFile(path, []byte("collectors:\n  cpus: false\n"), 0644)
+	rec = httptest.NewRecorder()
+	server.ReloadHandler().ServeHTTP(rec, httptest.NewRequest("POST", "/-/reload", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	code, _ = scrape(server, "/metrics?collect[]=cpus")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, body = scrape(server, "/metrics?collect[]=fairshare")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `slurm_exporter_collector_success{collector="fairshare"} 0`)
+
+	// A broken configuration keeps the running one
+	ioutil.WriteFile(path, []byte("collectors:\n  foo: true\n"), 0644)
+	rec = httptest.NewRecorder()
+	server.ReloadHandler().ServeHTTP(rec, httptest.NewRequest("POST", "/-/reload", nil))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	code, _ = scrape(server, "/metrics?collect[]=fairshare")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestServerReloadWebConfig(t *testing.T) {
+	defaults := testDefaults()
+	defaults.Slurm.BinDir = t.TempDir()
+	path := writeConfig(t, "collectors:\n  fairshare: false\n")
+	server, err := NewServer(defaults, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	oldHash, _ := bcrypt.GenerateFromPassword([]byte("old"), bcrypt.MinCost)
+	newHash, _ := bcrypt.GenerateFromPassword([]byte("new"), bcrypt.MinCost)
+	webPath := writeWebConfig(t, dir, "basic_auth_users:\n  prometheus: "+string(oldHash)+"\n")
+	if server.Web, err = NewWebServer(webPath); err != nil {
+		t.Fatal(err)
+	}
+	handler := server.Web.Handler(server)
+
+	// A broken configuration keeps the running web configuration as well
+	writeWebConfig(t, dir, "basic_auth_users:\n  prometheus: "+string(newHash)+"\n")
+	ioutil.WriteFile(path, []byte("collectors:\n  foo: true\n"), 0644)
+	assert.Error(t, server.Reload())
+	assert.Equal(t, http.StatusOK, webStatus(handler, "prometheus", "old"))
+	assert.Equal(t, http.StatusUnauthorized, webStatus(handler, "prometheus", "new"))
+
+	ioutil.WriteFile(path, []byte("collectors:\n  fairshare: false\n"), 0644)
+	assert.NoError(t, server.Reload())
+	assert.Equal(t, http.StatusUnauthorized, webStatus(handler, "prometheus", "old"))
+	assert.Equal(t, http.StatusOK, webStatus(handler, "prometheus", "new"))
+}
+
+func TestServerReloadKeepsState(t *testing.T) {
+	dir := t.TempDir()
+	// Slurm commands printing the content of a file
+	for _, command := range []string{"sdiag", "squeue"} {
+		script := "#!/bin/sh\ncat " + filepath.Join(dir, command+".txt") + "\n"
+		if err := ioutil.WriteFile(filepath.Join(dir, command), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	output := func(command string, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, command+".txt"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	job := func(id string) string {
+		return squeueLine(id, "RUNNING", "12", "normal", "foo", "physics", "normal", "1", "4000M", "N/A", "1-00:00:00", "10:00",
+			"2021-03-01T08:00:00", "2021-03-01T08:10:00", "cpu=12,mem=4000M,node=1,billing=12", "None", "sim_run")
+	}
+	defaults := testDefaults()
+	defaults.Slurm.BinDir = dir
+	defaults.Slurm.Paths = map[string]string{}
+	path := writeConfig(t, "collectors:\n  cpus: false\n  fairshare: false\n  queue: true\n  scheduler: true\n")
+	server, err := NewServer(defaults, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output("sdiag", "Data since      Wed Apr 12 00:00:00 2017\nJobs submitted: 100\n")
+	output("squeue", job("1"))
+	_, body := scrape(server, "/metrics")
+	assert.Contains(t, body, "slurm_scheduler_jobs_submitted_total 100\n")
+
+	assert.NoError(t, server.Reload())
+
+	// The counters continue after the statistics were reset at midnight, the
+	// job started since the scrape before the reload is observed
+	output("sdiag", "Data since      Thu Apr 13 00:00:00 2017\nJobs submitted: 20\n")
+	output("squeue", job("1")+job("2"))
+	_, body = scrape(server, "/metrics")
+	assert.Contains(t, body, "slurm_scheduler_jobs_submitted_total 120\n")
+	assert.Contains(t, body, `slurm_queue_start_wait_seconds_count{partition="normal",qos="normal"} 1`)
+}
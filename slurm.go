@@ -0,0 +1,54 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+// Slurm gives the collectors access to a source of Slurm data and to the
+// snapshots of data shared between them.
+type Slurm struct {
+	Source
+	jobs  *snapshot
+	nodes *snapshot
+}
+
+func NewSlurm(source Source) *Slurm {
+	return &Slurm{
+		Source: source,
+		jobs: newSnapshot(func() (interface{}, error) {
+			return source.Jobs()
+		}),
+		nodes: newSnapshot(func() (interface{}, error) {
+			return source.Nodes()
+		}),
+	}
+}
+
+// Jobs returns all jobs known to Slurm
+func (s *Slurm) Jobs() ([]Job, error) {
+	jobs, err := s.jobs.get()
+	if err != nil {
+		return nil, err
+	}
+	return jobs.([]Job), nil
+}
+
+// Nodes returns all nodes known to Slurm, once for each of their partitions
+func (s *Slurm) Nodes() ([]Node, error) {
+	nodes, err := s.nodes.get()
+	if err != nil {
+		return nil, err
+	}
+	return nodes.([]Node), nil
+}
@@ -0,0 +1,272 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/common/log"
+)
+
+// Source provides the data of a Slurm cluster to the collectors, either
+// from the Slurm commands or from the REST API of slurmrestd.
+type Source interface {
+	// All jobs and job array tasks
+	Jobs() ([]Job, error)
+	// All nodes, once for each of their partitions
+	Nodes() ([]Node, error)
+	// Statistics of the scheduler
+	Diag() (*SchedulerMetrics, error)
+	// Fair share per account
+	Shares() (map[string]*FairShareMetrics, error)
+	// Number of GPUs allocated to running jobs
+	AllocatedGPUs() (float64, error)
+	// Primary and backup slurmctld
+	Controllers() ([]Controller, error)
+}
+
+// Output formats of the Slurm commands
+const (
+	FormatAuto = "auto"
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// First Slurm version supporting the --json option of a command
+var jsonVersions = map[string][2]int{
+	"squeue":   {21, 8},
+	"scontrol": {21, 8},
+	"sdiag":    {23, 2},
+	// Only the ping subcommand, not covered by the scontrol version above
+	"scontrol ping": {23, 2},
+}
+
+// CommandSource reads the Slurm data from the output of the Slurm commands
+type CommandSource struct {
+	runner Runner
+	// Commands whose --json output is parsed instead of their text output
+	mu   sync.RWMutex
+	json map[string]bool
+	// Fall back to the text output of a command if its JSON output fails
+	fallback bool
+}
+
+func NewCommandSource(runner Runner) *CommandSource {
+	return &CommandSource{
+		runner: runner,
+		json:   make(map[string]bool),
+	}
+}
+
+// SetFormat selects the output format of the Slurm commands. The auto format
+// uses the JSON output of every command supporting it in the installed
+// version of Slurm, and the text output if the version is unknown. It falls
+// back to the text output of a command whose JSON output fails, e.g.
+// without the data_parser plugin.
+func (s *CommandSource) SetFormat(format string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fallback = false
+	switch format {
+	case FormatText:
+		s.json = make(map[string]bool)
+	case FormatJSON:
+		for command := range jsonVersions {
+			s.json[command] = true
+		}
+	case FormatAuto:
+		version, err := SlurmVersion(s.runner)
+		if err != nil {
+			log.Warnf("Using the text output of the Slurm commands: %v", err)
+			s.json = make(map[string]bool)
+			return nil
+		}
+		s.fallback = true
+		var commands []string
+		for command, first := range jsonVersions {
+			s.json[command] = version[0] > first[0] || (version[0] == first[0] && version[1] >= first[1])
+			if s.json[command] {
+				commands = append(commands, command)
+			}
+		}
+		sort.Strings(commands)
+		log.Infof("Slurm %d.%02d, using the JSON output of: %s", version[0], version[1], strings.Join(commands, ", "))
+	default:
+		return fmt.Errorf("unknown output format %q", format)
+	}
+	return nil
+}
+
+// SlurmVersion returns the major and minor version of the installed Slurm
+func SlurmVersion(runner Runner) ([2]int, error) {
+	var version [2]int
+	out, err := runner.Run("sinfo", "--version")
+	if err != nil {
+		return version, err
+	}
+	// e.g. "slurm 23.11.5" or "slurm-wlm 21.08.5"
+	match := regexp.MustCompile(`(\d+)\.(\d+)`).FindStringSubmatch(string(out))
+	if match == nil {
+		return version, fmt.Errorf("unknown Slurm version %q", strings.TrimSpace(string(out)))
+	}
+	version[0], _ = strconv.Atoi(match[1])
+	version[1], _ = strconv.Atoi(match[2])
+	return version, nil
+}
+
+// Whether the JSON output of the command is used
+func (s *CommandSource) usesJSON(command string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.json[command]
+}
+
+// Whether to run the text command after its JSON output failed. The text
+// output is used from then on if it succeeds where the JSON output failed,
+// both fail if slurmctld does not respond.
+func (s *CommandSource) fallBack(command string, jsonErr error) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.fallback {
+		log.Warnf("Trying the text output of %s: %v", command, jsonErr)
+	}
+	return s.fallback
+}
+
+func (s *CommandSource) fellBack(command string, textErr error) {
+	if textErr != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.json[command] {
+		log.Warnf("Using the text output of %s", command)
+		s.json[command] = false
+	}
+}
+
+// Run a command with the --json option and check the reported errors
+func (s *CommandSource) runJSON(command string, args ...string) ([]byte, error) {
+	out, err := s.runner.Run(command, append([]string{"--json"}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckJSONErrors(out); err != nil {
+		return nil, fmt.Errorf("%s --json: %v", command, err)
+	}
+	return out, nil
+}
+
+func (s *CommandSource) Jobs() ([]Job, error) {
+	if s.usesJSON("squeue") {
+		jobs, err := s.jobsJSON()
+		if err == nil || !s.fallBack("squeue", err) {
+			return jobs, err
+		}
+		jobs, err = JobsGetMetrics(s.runner)
+		s.fellBack("squeue", err)
+		return jobs, err
+	}
+	return JobsGetMetrics(s.runner)
+}
+
+func (s *CommandSource) jobsJSON() ([]Job, error) {
+	data, err := s.runJSON("squeue", "-a")
+	if err != nil {
+		return nil, err
+	}
+	return ParseJobsJSON(data)
+}
+
+// sinfo --json aggregates the nodes, scontrol lists every single node
+func (s *CommandSource) Nodes() ([]Node, error) {
+	if s.usesJSON("scontrol") {
+		nodes, err := s.nodesJSON()
+		if err == nil || !s.fallBack("scontrol", err) {
+			return nodes, err
+		}
+		nodes, err = NodeListGetMetrics(s.runner)
+		s.fellBack("scontrol", err)
+		return nodes, err
+	}
+	return NodeListGetMetrics(s.runner)
+}
+
+func (s *CommandSource) nodesJSON() ([]Node, error) {
+	data, err := s.runJSON("scontrol", "--all", "show", "nodes")
+	if err != nil {
+		return nil, err
+	}
+	return ParseNodesJSON(data)
+}
+
+func (s *CommandSource) Diag() (*SchedulerMetrics, error) {
+	if s.usesJSON("sdiag") {
+		sm, err := s.diagJSON()
+		if err == nil || !s.fallBack("sdiag", err) {
+			return sm, err
+		}
+		sm, err = SchedulerGetMetrics(s.runner)
+		s.fellBack("sdiag", err)
+		return sm, err
+	}
+	return SchedulerGetMetrics(s.runner)
+}
+
+func (s *CommandSource) diagJSON() (*SchedulerMetrics, error) {
+	data, err := s.runJSON("sdiag")
+	if err != nil {
+		return nil, err
+	}
+	return ParseDiagJSON(data)
+}
+
+func (s *CommandSource) Shares() (map[string]*FairShareMetrics, error) {
+	return FairShareGetMetrics(s.runner)
+}
+
+func (s *CommandSource) AllocatedGPUs() (float64, error) {
+	return ParseAllocatedGPUs(s.runner)
+}
+
+func (s *CommandSource) Controllers() ([]Controller, error) {
+	if s.usesJSON("scontrol ping") {
+		controllers, err := s.controllersJSON()
+		if err == nil || !s.fallBack("scontrol ping", err) {
+			return controllers, err
+		}
+		controllers, err = ControllersGetMetrics(s.runner)
+		s.fellBack("scontrol ping", err)
+		return controllers, err
+	}
+	return ControllersGetMetrics(s.runner)
+}
+
+func (s *CommandSource) controllersJSON() ([]Controller, error) {
+	data, err := pingOutput(s.runner.Run("scontrol", "--json", "ping"))
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckJSONErrors(data); err != nil {
+		return nil, fmt.Errorf("scontrol --json ping: %v", err)
+	}
+	return ParsePingJSON(data)
+}
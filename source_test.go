@@ -0,0 +1,141 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandSourceAutoFormat(t *testing.T) {
+	runner := NewFakeRunner()
+	runner.Output["sinfo --version"] = []byte("slurm-wlm 22.05.8\n")
+	source := NewCommandSource(runner)
+	assert.Nil(t, source.SetFormat(FormatAuto))
+	assert.Equal(t, map[string]bool{"squeue": true, "scontrol": true, "scontrol ping": false, "sdiag": false}, source.json)
+
+	runner.Output["sinfo --version"] = []byte("slurm 20.11.9\n")
+	assert.Nil(t, source.SetFormat(FormatAuto))
+	assert.Equal(t, map[string]bool{"squeue": false, "scontrol": false, "scontrol ping": false, "sdiag": false}, source.json)
+
+	// Fall back to the text output if the version is unknown
+	runner.Errors["sinfo --version"] = errors.New("sinfo: command not found")
+	assert.Nil(t, source.SetFormat(FormatAuto))
+	assert.Empty(t, source.json)
+
+	assert.Error(t, source.SetFormat("xml"))
+}
+
+func TestCommandSourceJSONFallback(t *testing.T) {
+	runner := NewFakeRunner().File(t, "squeue", "test_data/squeue.txt")
+	runner.Output["sinfo --version"] = []byte("slurm 23.11.5\n")
+	runner.Errors["squeue --json -a"] = &CommandError{Command: "squeue", Args: []string{"--json", "-a"}, Err: errors.New("exit status 1"), Stderr: "squeue: error: data_parser plugin not found"}
+	runner.Errors["sdiag --json"] = errors.New("slurm_get_statistics: Unable to contact slurm controller")
+	runner.Errors["sdiag"] = errors.New("slurm_get_statistics: Unable to contact slurm controller")
+	source := NewCommandSource(runner)
+	assert.Nil(t, source.SetFormat(FormatAuto))
+
+	// The text output is used where the JSON output fails
+	jobs, err := source.Jobs()
+	assert.NoError(t, err)
+	assert.Equal(t, 42, len(jobs))
+	assert.False(t, source.usesJSON("squeue"))
+	runner.Calls = nil
+	source.Jobs()
+	assert.Equal(t, 1, len(runner.Calls))
+	assert.True(t, strings.HasPrefix(runner.Calls[0], "squeue -a -r "))
+
+	// Both fail if slurmctld does not respond, the JSON output is kept
+	_, err = source.Diag()
+	assert.Error(t, err)
+	assert.True(t, source.usesJSON("sdiag"))
+
+	// The JSON output was asked for explicitly
+	assert.Nil(t, source.SetFormat(FormatJSON))
+	_, err = source.Jobs()
+	assert.Error(t, err)
+}
+
+func TestCommandSourceJSON(t *testing.T) {
+	runner := NewFakeRunner().
+		File(t, "squeue --json -a", "test_data/slurmrestd/jobs.json").
+		File(t, "scontrol --json --all show nodes", "test_data/slurmrestd/nodes.json").
+		File(t, "sdiag --json", "test_data/slurmrestd/diag.json")
+	source := NewCommandSource(runner)
+	assert.Nil(t, source.SetFormat(FormatJSON))
+	collectors, err := NewCollectors(source, []string{"cpus", "partitions", "scheduler", "users"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := NewSlurmExporter(collectors)
+	expected := `
+# HELP slurm_cpus_total Total CPUs
+# TYPE slurm_cpus_total gauge
+slurm_cpus_total 288
+# HELP slurm_partition_jobs_pending Pending jobs for partition
+# TYPE slurm_partition_jobs_pending gauge
+slurm_partition_jobs_pending{partition="long"} 4
+# HELP slurm_scheduler_threads Information provided by the Slurm sdiag command, number of scheduler threads 
+# TYPE slurm_scheduler_threads gauge
+slurm_scheduler_threads 3
+# HELP slurm_user_jobs_running Running jobs for user
+# TYPE slurm_user_jobs_running gauge
+slurm_user_jobs_running{user="bar"} 9
+slurm_user_jobs_running{user="foo"} 19
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected),
+		"slurm_cpus_total", "slurm_partition_jobs_pending", "slurm_scheduler_threads", "slurm_user_jobs_running"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCommandSourceJSONSharesJobs(t *testing.T) {
+	runner := NewFakeRunner().File(t, "squeue --json -a", "test_data/slurmrestd/jobs.json")
+	source := NewCommandSource(runner)
+	assert.Nil(t, source.SetFormat(FormatJSON))
+	collectors, err := NewCollectors(source, []string{"tres", "users"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CollectAndCompare(NewSlurmExporter(collectors), strings.NewReader(""))
+	// The TRES of the jobs come with the snapshot of all jobs
+	assert.Equal(t, []string{"squeue --json -a"}, runner.Calls)
+}
+
+func TestCommandSourceTextSharesJobs(t *testing.T) {
+	runner := NewFakeRunner().File(t, "squeue", "test_data/squeue.txt")
+	collectors, err := NewCollectors(NewCommandSource(runner), []string{"tres", "users"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CollectAndCompare(NewSlurmExporter(collectors), strings.NewReader(""))
+	// squeue -O lists the TRES as well, no sacct
+	assert.Equal(t, 1, len(runner.Calls))
+	assert.True(t, strings.HasPrefix(runner.Calls[0], "squeue "), runner.Calls[0])
+}
+
+func TestCommandSourceJSONErrors(t *testing.T) {
+	runner := NewFakeRunner()
+	runner.Output["squeue"] = []byte(`{"jobs": [], "errors": [{"error": "Unable to contact slurm controller (connect failure)"}]}`)
+	source := NewCommandSource(runner)
+	assert.Nil(t, source.SetFormat(FormatJSON))
+	_, err := source.Jobs()
+	assert.EqualError(t, err, "squeue --json: Unable to contact slurm controller (connect failure)")
+}
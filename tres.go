@@ -0,0 +1,138 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/*
+ * Trackable resources (TRES) are reported by Slurm as comma separated
+ * lists like "billing=4,cpu=4,gres/gpu=1,gres/gpu:a100=1,mem=16G,node=1".
+ * Typed generic resources are listed next to their total, e.g. gres/gpu
+ * counts all GPUs and gres/gpu:a100 only the A100 ones.
+ */
+
+// TRES holds the count of every trackable resource by name, memory and
+// other sizes in bytes
+type TRES map[string]float64
+
+// TRES counted in megabytes by Slurm, converted into bytes
+var tresSizes = map[string]bool{"mem": true, "vmem": true, "fs/disk": true}
+
+// ParseTRES parses a TRES string, unknown values are skipped
+func ParseTRES(s string) TRES {
+	tres := make(TRES)
+	for _, entry := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			continue
+		}
+		name := kv[0]
+		if tresSizes[name] || strings.HasPrefix(name, "bb/") {
+			tres[name] += ParseMemory(kv[1])
+			continue
+		}
+		value, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil {
+			continue
+		}
+		tres[name] += value
+	}
+	return tres
+}
+
+// Add the resources of other
+func (t TRES) Add(other TRES) {
+	for name, value := range other {
+		t[name] += value
+	}
+}
+
+type tresKey struct {
+	partition string
+	account   string
+	user      string
+	tres      string
+}
+
+// ParseTRESMetrics sums up the TRES allocated to the running jobs and
+// requested by the pending jobs
+func ParseTRESMetrics(jobs []Job) (allocated, requested map[tresKey]float64) {
+	allocated = make(map[tresKey]float64)
+	requested = make(map[tresKey]float64)
+	for _, job := range jobs {
+		var tres TRES
+		var sums map[tresKey]float64
+		switch job.State {
+		case "RUNNING":
+			tres, sums = job.AllocTRES, allocated
+		case "PENDING":
+			tres, sums = job.ReqTRES, requested
+		default:
+			continue
+		}
+		for name, value := range tres {
+			sums[tresKey{job.Partition, job.Account, job.User, name}] += value
+		}
+	}
+	return allocated, requested
+}
+
+/*
+ * The TRESCollector exposes the TRES allocated to the running jobs and
+ * requested by the pending jobs per partition, account and user, e.g. the
+ * billing units for chargeback. The TRES come with the jobs listed by
+ * squeue, shared with the other collectors of jobs.
+ */
+
+type TRESCollector struct {
+	slurm     *Slurm
+	allocated *prometheus.Desc
+	requested *prometheus.Desc
+}
+
+func NewTRESCollector(slurm *Slurm) *TRESCollector {
+	labels := []string{"partition", "account", "user", "tres"}
+	return &TRESCollector{
+		slurm:     slurm,
+		allocated: prometheus.NewDesc("slurm_tres_allocated", "TRES allocated to the running jobs, memory in bytes", labels, nil),
+		requested: prometheus.NewDesc("slurm_tres_requested", "TRES requested by the pending jobs, memory in bytes", labels, nil),
+	}
+}
+
+func (tc *TRESCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tc.allocated
+	ch <- tc.requested
+}
+
+func (tc *TRESCollector) Update(ch chan<- prometheus.Metric) error {
+	jobs, err := tc.slurm.Jobs()
+	if err != nil {
+		return err
+	}
+	allocated, requested := ParseTRESMetrics(jobs)
+	for k, value := range allocated {
+		ch <- prometheus.MustNewConstMetric(tc.allocated, prometheus.GaugeValue, value, k.partition, k.account, k.user, k.tres)
+	}
+	for k, value := range requested {
+		ch <- prometheus.MustNewConstMetric(tc.requested, prometheus.GaugeValue, value, k.partition, k.account, k.user, k.tres)
+	}
+	return nil
+}
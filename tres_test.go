@@ -0,0 +1,91 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTRES(t *testing.T) {
+	assert.Equal(t, TRES{
+		"billing":       4,
+		"cpu":           4,
+		"gres/gpu":      1,
+		"gres/gpu:a100": 1,
+		"mem":           16 << 30,
+		"node":          1,
+		"license/ansys": 2,
+	}, ParseTRES("billing=4,cpu=4,gres/gpu=1,gres/gpu:a100=1,mem=16G,node=1,license/ansys=2"))
+	assert.Equal(t, TRES{"mem": 500 << 20}, ParseTRES("mem=500"))
+	assert.Equal(t, TRES{}, ParseTRES(""))
+	assert.Equal(t, TRES{}, ParseTRES("gpu:2"))
+}
+
+func TestAllocatedGPUs(t *testing.T) {
+	runner := NewFakeRunner()
+	runner.Output["sacct"] = []byte("billing=4,cpu=4,gres/gpu=1,mem=16G,node=1\nbilling=8,cpu=8,gres/gpu=2,gres/gpu:a100=2,mem=32G,node=1\ncpu=1,mem=1G,node=1\n")
+	gpus, err := ParseAllocatedGPUs(runner)
+	assert.NoError(t, err)
+	assert.Equal(t, 3.0, gpus)
+}
+
+func TestTRESCollector(t *testing.T) {
+	runner := NewFakeRunner()
+	job := func(id, state, partition, account, user, tres string) string {
+		return squeueLine(id, state, "12", partition, user, account, "normal", "1", "N/A", "N/A", "1-00:00:00", "10:00",
+			"2021-03-01T09:00:00", "2021-03-01T09:10:00", tres, "None", "job")
+	}
+	// squeue lists the requested TRES of pending jobs as tres-alloc
+	runner.Output["squeue"] = []byte(job("15451729", "RUNNING", "normal", "physics", "foo", "billing=12,cpu=12,mem=4000M,node=1") +
+		job("15451730", "RUNNING", "normal", "physics", "foo", "billing=12,cpu=12,mem=4000M,node=1") +
+		job("15452443", "RUNNING", "long", "chemistry", "bar", "billing=24,cpu=12,gres/gpu=4,gres/gpu:a100=4,mem=16G,node=2") +
+		job("15452423", "PENDING", "long", "chemistry", "bar", "billing=12,cpu=12,gres/gpu=1,gres/gpu:a100=1,mem=8G,node=1") +
+		job("15452420", "PENDING", "long", "chemistry", "bar", "billing=12,cpu=12,license/matlab=1,mem=8G,node=1") +
+		job("15452421", "COMPLETING", "long", "chemistry", "bar", "billing=12,cpu=12,mem=8G,node=1"))
+	collector := NewTRESCollector(NewSlurm(NewCommandSource(runner)))
+	expected := `
+# HELP slurm_tres_allocated TRES allocated to the running jobs, memory in bytes
+# TYPE slurm_tres_allocated gauge
+slurm_tres_allocated{account="chemistry",partition="long",tres="billing",user="bar"} 24
+slurm_tres_allocated{account="chemistry",partition="long",tres="cpu",user="bar"} 12
+slurm_tres_allocated{account="chemistry",partition="long",tres="gres/gpu",user="bar"} 4
+slurm_tres_allocated{account="chemistry",partition="long",tres="gres/gpu:a100",user="bar"} 4
+slurm_tres_allocated{account="chemistry",partition="long",tres="mem",user="bar"} 1.7179869184e+10
+slurm_tres_allocated{account="chemistry",partition="long",tres="node",user="bar"} 2
+slurm_tres_allocated{account="physics",partition="normal",tres="billing",user="foo"} 24
+slurm_tres_allocated{account="physics",partition="normal",tres="cpu",user="foo"} 24
+slurm_tres_allocated{account="physics",partition="normal",tres="mem",user="foo"} 8.388608e+09
+slurm_tres_allocated{account="physics",partition="normal",tres="node",user="foo"} 2
+# HELP slurm_tres_requested TRES requested by the pending jobs, memory in bytes
+# TYPE slurm_tres_requested gauge
+slurm_tres_requested{account="chemistry",partition="long",tres="billing",user="bar"} 24
+slurm_tres_requested{account="chemistry",partition="long",tres="cpu",user="bar"} 24
+slurm_tres_requested{account="chemistry",partition="long",tres="gres/gpu",user="bar"} 1
+slurm_tres_requested{account="chemistry",partition="long",tres="gres/gpu:a100",user="bar"} 1
+slurm_tres_requested{account="chemistry",partition="long",tres="license/matlab",user="bar"} 1
+slurm_tres_requested{account="chemistry",partition="long",tres="mem",user="bar"} 1.7179869184e+10
+slurm_tres_requested{account="chemistry",partition="long",tres="node",user="bar"} 2
+`
+	exporter := NewSlurmExporter(map[string]Collector{"tres": collector})
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected),
+		"slurm_tres_allocated", "slurm_tres_requested"); err != nil {
+		t.Error(err)
+	}
+}
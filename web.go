@@ -0,0 +1,321 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+/*
+ * Support for the web configuration file shared by the Prometheus
+ * exporters, enabling TLS (optionally with client certificates) and basic
+ * authentication with bcrypt hashed passwords:
+ *
+ *   tls_server_config:
+ *     cert_file: /etc/slurm-exporter/tls.crt
+ *     key_file: /etc/slurm-exporter/tls.key
+ *     client_auth_type: RequireAndVerifyClientCert
+ *     client_ca_file: /etc/slurm-exporter/ca.crt
+ *   basic_auth_users:
+ *     prometheus: $2y$10$...
+ *
+ * The file is loaded on startup and reloaded together with the main
+ * configuration, on SIGHUP or a POST to /-/reload.
+ */
+
+type WebConfig struct {
+	TLSConfig  WebTLSConfig      `yaml:"tls_server_config"`
+	HTTPConfig WebHTTPConfig     `yaml:"http_server_config"`
+	Users      map[string]string `yaml:"basic_auth_users"`
+}
+
+type WebTLSConfig struct {
+	CertFile                 string   `yaml:"cert_file"`
+	KeyFile                  string   `yaml:"key_file"`
+	ClientAuth               string   `yaml:"client_auth_type"`
+	ClientCAs                string   `yaml:"client_ca_file"`
+	CipherSuites             []string `yaml:"cipher_suites"`
+	CurvePreferences         []string `yaml:"curve_preferences"`
+	MinVersion               string   `yaml:"min_version"`
+	MaxVersion               string   `yaml:"max_version"`
+	PreferServerCipherSuites bool     `yaml:"prefer_server_cipher_suites"`
+}
+
+type WebHTTPConfig struct {
+	HTTP2   *bool             `yaml:"http2"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+func LoadWebConfig(path string) (*WebConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config WebConfig
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	tc := config.TLSConfig
+	if (tc.CertFile == "") != (tc.KeyFile == "") {
+		return nil, fmt.Errorf("%s: cert_file and key_file have to be set together", path)
+	}
+	if tc.CertFile == "" && (tc.ClientCAs != "" || tc.ClientAuth != "") {
+		return nil, fmt.Errorf("%s: client authentication requires cert_file and key_file", path)
+	}
+	return &config, nil
+}
+
+// TLS enabled by the configuration
+func (c *WebConfig) tlsEnabled() bool {
+	return c.TLSConfig.CertFile != ""
+}
+
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+var tlsClientAuth = map[string]tls.ClientAuthType{
+	"":                           tls.NoClientCert,
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"CurveP256": tls.CurveP256,
+	"CurveP384": tls.CurveP384,
+	"CurveP521": tls.CurveP521,
+	"X25519":    tls.X25519,
+}
+
+// Build the TLS configuration of the server
+func (c *WebConfig) serverTLSConfig() (*tls.Config, error) {
+	tc := c.TLSConfig
+	config := &tls.Config{
+		MinVersion:               tls.VersionTLS12,
+		PreferServerCipherSuites: tc.PreferServerCipherSuites,
+	}
+	cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config.Certificates = []tls.Certificate{cert}
+	// The configuration returned per handshake has to announce HTTP/2 itself
+	if c.HTTPConfig.HTTP2 == nil || *c.HTTPConfig.HTTP2 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	} else {
+		config.NextProtos = []string{"http/1.1"}
+	}
+	if tc.MinVersion != "" {
+		version, ok := tlsVersions[tc.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q", tc.MinVersion)
+		}
+		config.MinVersion = version
+	}
+	if tc.MaxVersion != "" {
+		version, ok := tlsVersions[tc.MaxVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q", tc.MaxVersion)
+		}
+		config.MaxVersion = version
+	}
+	if len(tc.CipherSuites) > 0 {
+		suites := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range tc.CipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown cipher suite %q", name)
+			}
+			config.CipherSuites = append(config.CipherSuites, id)
+		}
+	}
+	for _, name := range tc.CurvePreferences {
+		curve, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q", name)
+		}
+		config.CurvePreferences = append(config.CurvePreferences, curve)
+	}
+	clientAuth, ok := tlsClientAuth[tc.ClientAuth]
+	if !ok {
+		return nil, fmt.Errorf("unknown client_auth_type %q", tc.ClientAuth)
+	}
+	config.ClientAuth = clientAuth
+	if tc.ClientCAs != "" {
+		pem, err := ioutil.ReadFile(tc.ClientCAs)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", tc.ClientCAs)
+		}
+		config.ClientCAs = pool
+	} else if clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert {
+		return nil, errors.New("client_ca_file is required to verify client certificates")
+	}
+	return config, nil
+}
+
+/*
+ * The WebServer holds the web configuration loaded from the file, and the
+ * TLS configuration built from it. On reload both are replaced once the new
+ * ones are complete, a file which fails to load leaves the running
+ * configuration in place.
+ */
+
+type WebServer struct {
+	path string
+
+	mu        sync.RWMutex
+	config    *WebConfig
+	tlsConfig *tls.Config
+}
+
+// NewWebServer loads the web configuration file, without a file plain HTTP
+// is served without authentication
+func NewWebServer(path string) (*WebServer, error) {
+	s := &WebServer{path: path}
+	if path == "" {
+		s.config = &WebConfig{}
+		return s, nil
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload the web configuration file, picking up renewed certificates and
+// changed users. TLS can not be enabled or disabled without a restart.
+func (s *WebServer) Reload() error {
+	config, tlsConfig, err := s.load()
+	if err != nil {
+		return err
+	}
+	s.set(config, tlsConfig)
+	return nil
+}
+
+// Read and validate the web configuration file without applying it, nil
+// without a file
+func (s *WebServer) load() (*WebConfig, *tls.Config, error) {
+	if s.path == "" {
+		return nil, nil, nil
+	}
+	config, err := LoadWebConfig(s.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var tlsConfig *tls.Config
+	if config.tlsEnabled() {
+		if tlsConfig, err = config.serverTLSConfig(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if current, _ := s.current(); current != nil && current.tlsEnabled() != config.tlsEnabled() {
+		return nil, nil, fmt.Errorf("%s: enabling or disabling TLS requires a restart", s.path)
+	}
+	return config, tlsConfig, nil
+}
+
+// Apply a configuration returned by load
+func (s *WebServer) set(config *WebConfig, tlsConfig *tls.Config) {
+	if config == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = config
+	s.tlsConfig = tlsConfig
+}
+
+func (s *WebServer) current() (*WebConfig, *tls.Config) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config, s.tlsConfig
+}
+
+// Handler checks the basic authentication of every request before passing
+// it on to the handler
+func (s *WebServer) Handler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config, _ := s.current()
+		for name, value := range config.HTTPConfig.Headers {
+			w.Header().Set(name, value)
+		}
+		if len(config.Users) > 0 {
+			user, pass, ok := r.BasicAuth()
+			if !ok || !authenticate(config.Users, user, pass) {
+				w.Header().Set("WWW-Authenticate", "Basic")
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Check the password of a user against its bcrypt hash. The results are not
+// cached, a cache would answer guesses without the cost of bcrypt.
+func authenticate(users map[string]string, user string, pass string) bool {
+	hash, ok := users[user]
+	if !ok {
+		// Compare against a dummy hash, taking as long as for a known user
+		hash = "$2y$10$QOauhQNbBCuQDKes6eFzPeMqBSjb7Mr5DUmpZ/VcEd00UAV/LDeSi"
+	}
+	valid := bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+	return ok && valid
+}
+
+// ListenAndServe serves HTTP or HTTPS depending on the web configuration,
+// the server's handler defaults to http.DefaultServeMux like in
+// http.ListenAndServe.
+func (s *WebServer) ListenAndServe(server *http.Server) error {
+	handler := server.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	server.Handler = s.Handler(handler)
+	if config, _ := s.current(); !config.tlsEnabled() {
+		return server.ListenAndServe()
+	}
+	server.TLSConfig = &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			_, tlsConfig := s.current()
+			return tlsConfig, nil
+		},
+	}
+	return server.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,201 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeWebConfig(t *testing.T, dir string, content string) string {
+	path := filepath.Join(dir, "web.yml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Write a self-signed certificate for 127.0.0.1 and its key
+func writeCertificate(t *testing.T, dir string) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "slurm-exporter"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile, cert
+}
+
+func TestWebBasicAuth(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	path := writeWebConfig(t, t.TempDir(), `
+basic_auth_users:
+  prometheus: `+string(hash)+`
+http_server_config:
+  headers:
+    X-Frame-Options: deny
+`)
+	web, err := NewWebServer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := web.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("metrics"))
+	}))
+
+	for _, c := range []struct {
+		user, pass string
+		code       int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"prometheus", "wrong", http.StatusUnauthorized},
+		{"nobody", "secret", http.StatusUnauthorized},
+		{"prometheus", "secret", http.StatusOK},
+		{"prometheus", "secret", http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if c.user != "" {
+			req.SetBasicAuth(c.user, c.pass)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, c.code, rec.Code, c.user+":"+c.pass)
+		assert.Equal(t, "deny", rec.Header().Get("X-Frame-Options"))
+	}
+}
+
+// Request the handler with basic authentication
+func webStatus(handler http.Handler, user string, pass string) int {
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.SetBasicAuth(user, pass)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestWebReload(t *testing.T) {
+	dir := t.TempDir()
+	oldHash, _ := bcrypt.GenerateFromPassword([]byte("old"), bcrypt.MinCost)
+	newHash, _ := bcrypt.GenerateFromPassword([]byte("new"), bcrypt.MinCost)
+	path := writeWebConfig(t, dir, "basic_auth_users:\n  prometheus: "+string(oldHash)+"\n")
+	web, err := NewWebServer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := web.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// Changes are only picked up on reload
+	writeWebConfig(t, dir, "basic_auth_users:\n  prometheus: "+string(newHash)+"\n")
+	assert.Equal(t, http.StatusOK, webStatus(handler, "prometheus", "old"))
+	assert.NoError(t, web.Reload())
+	assert.Equal(t, http.StatusUnauthorized, webStatus(handler, "prometheus", "old"))
+	assert.Equal(t, http.StatusOK, webStatus(handler, "prometheus", "new"))
+
+	// A broken file leaves the running configuration in place
+	writeWebConfig(t, dir, "basic_auth_user:\n")
+	assert.Error(t, web.Reload())
+	assert.Equal(t, http.StatusOK, webStatus(handler, "prometheus", "new"))
+
+	// TLS can not be enabled on reload
+	certFile, keyFile, _ := writeCertificate(t, dir)
+	writeWebConfig(t, dir, "tls_server_config:\n  cert_file: "+certFile+"\n  key_file: "+keyFile+"\n")
+	assert.Error(t, web.Reload())
+	assert.Equal(t, http.StatusOK, webStatus(handler, "prometheus", "new"))
+}
+
+func TestWebConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	for _, content := range []string{
+		"tls_server_config:\n  cert_file: tls.crt\n",
+		"tls_server_config:\n  client_ca_file: ca.crt\n",
+		"basic_auth_user:\n  prometheus: foo\n",
+	} {
+		_, err := LoadWebConfig(writeWebConfig(t, dir, content))
+		assert.Error(t, err, content)
+	}
+}
+
+func TestWebTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, cert := writeCertificate(t, dir)
+	web, err := NewWebServer(writeWebConfig(t, dir, `
+tls_server_config:
+  cert_file: `+certFile+`
+  key_file: `+keyFile+`
+  min_version: TLS13
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, tlsConfig := web.current()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("metrics"))
+	}))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "metrics", string(body))
+	assert.Equal(t, uint16(tls.VersionTLS13), resp.TLS.Version)
+
+	// Older TLS versions are refused
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, MaxVersion: tls.VersionTLS12}}}
+	_, err = client.Get(server.URL)
+	assert.Error(t, err)
+}